@@ -379,7 +379,7 @@ func rangeAggEvaluator(
 	expr *rangeAggregationExpr,
 	q Params,
 ) (StepEvaluator, error) {
-	agg, err := expr.aggregator()
+	agg, _, err := expr.aggregator()
 	if err != nil {
 		return nil, err
 	}
@@ -404,7 +404,7 @@ type rangeVectorEvaluator struct {
 }
 
 func (r rangeVectorEvaluator) Next() (bool, int64, promql.Vector) {
-	next := r.iter.Next()
+	next := nextLoaded(r.iter)
 	if !next {
 		return false, 0, promql.Vector{}
 	}
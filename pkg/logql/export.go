@@ -0,0 +1,315 @@
+package logql
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"io"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/memory"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// EncodeCSV writes the aggregated steps of the iterator as CSV, with a header row made of the
+// timestamp followed by one column per series (stringified labels), and one row per step.
+// Series can appear and disappear across steps, the columns being the union of all series, the
+// whole result is buffered before being written. Absent series are left blank for the step.
+// The iterator is consumed but not closed.
+func EncodeCSV(w io.Writer, it RangeVectorIterator, agg RangeVectorAggregator) error {
+	var (
+		steps   []int64
+		columns = map[string]map[int64]float64{}
+	)
+	for nextLoaded(it) {
+		ts, vec := it.At(agg)
+		steps = append(steps, ts)
+		for _, s := range vec {
+			lbs := s.Metric.String()
+			values, ok := columns[lbs]
+			if !ok {
+				values = map[int64]float64{}
+				columns[lbs] = values
+			}
+			values[ts] = s.V
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+
+	series := make([]string, 0, len(columns))
+	for lbs := range columns {
+		series = append(series, lbs)
+	}
+	sort.Strings(series)
+
+	cw := csv.NewWriter(w)
+	record := make([]string, 0, len(series)+1)
+	record = append(record, "timestamp")
+	record = append(record, series...)
+	if err := cw.Write(record); err != nil {
+		return err
+	}
+	for _, ts := range steps {
+		record = record[:0]
+		record = append(record, strconv.FormatInt(ts, 10))
+		for _, lbs := range series {
+			v, ok := columns[lbs][ts]
+			if !ok {
+				record = append(record, "")
+				continue
+			}
+			record = append(record, formatValue(v))
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// EncodeArrow returns the aggregated steps of the iterator as an Arrow record with one row per
+// step and series, made of a `timestamp` (ms), a `labels` and a `value` column.
+// The labels column is dictionary-encoded: rows hold int32 indices into the dictionary of the
+// stringified label sets, which is attached as the field metadata (index as key, labels as
+// value) since the pinned arrow version has no dictionary array type.
+// Series are added to the dictionary in the order they first appear (sorted within a step), so the dictionary is the
+// union of all series across steps. The caller must release the record.
+// The iterator is consumed but not closed.
+func EncodeArrow(it RangeVectorIterator, agg RangeVectorAggregator) (array.Record, error) {
+	mem := memory.NewGoAllocator()
+	timestamps := array.NewTimestampBuilder(mem, arrow.FixedWidthTypes.Timestamp_ms.(*arrow.TimestampType))
+	defer timestamps.Release()
+	indices := array.NewInt32Builder(mem)
+	defer indices.Release()
+	values := array.NewFloat64Builder(mem)
+	defer values.Release()
+
+	var (
+		dictionary []string
+		index      = map[string]int32{}
+	)
+	for nextLoaded(it) {
+		ts, vec := it.At(agg)
+		sort.Slice(vec, func(i, j int) bool { return labels.Compare(vec[i].Metric, vec[j].Metric) < 0 })
+		for _, s := range vec {
+			lbs := s.Metric.String()
+			i, ok := index[lbs]
+			if !ok {
+				i = int32(len(dictionary))
+				index[lbs] = i
+				dictionary = append(dictionary, lbs)
+			}
+			timestamps.Append(arrow.Timestamp(ts))
+			indices.Append(i)
+			values.Append(s.V)
+		}
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, len(dictionary))
+	for i := range dictionary {
+		keys[i] = strconv.Itoa(i)
+	}
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "timestamp", Type: arrow.FixedWidthTypes.Timestamp_ms},
+		{Name: "labels", Type: arrow.PrimitiveTypes.Int32, Metadata: arrow.NewMetadata(keys, dictionary)},
+		{Name: "value", Type: arrow.PrimitiveTypes.Float64},
+	}, nil)
+	cols := []array.Interface{timestamps.NewArray(), indices.NewArray(), values.NewArray()}
+	defer func() {
+		for _, c := range cols {
+			c.Release()
+		}
+	}()
+	return array.NewRecord(schema, cols, int64(cols[0].Len())), nil
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	tagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// nanoTimestamper is implemented by the iterators exposing the nanoseconds timestamp of their
+// current step, At only reporting milliseconds.
+type nanoTimestamper interface {
+	TimestampNano() int64
+}
+
+// EncodeLineProtocol writes the aggregated steps of the iterator as InfluxDB line protocol, one
+// line per sample: `measurement,tagset value=<aggregate> <timestamp>`. Labels become tags,
+// escaped per the line protocol rules, and timestamps are in nanoseconds, with the iterator
+// precision when it exposes them. The line protocol has no representation for NaN and infinite
+// values, those samples are skipped.
+// Samples are written as steps are aggregated. The iterator is consumed but not closed.
+func EncodeLineProtocol(w io.Writer, it RangeVectorIterator, agg RangeVectorAggregator, measurement string) error {
+	var (
+		line []byte
+		name = measurementEscaper.Replace(measurement)
+	)
+	nanos, hasNanos := it.(nanoTimestamper)
+	for nextLoaded(it) {
+		ts, vec := it.At(agg)
+		// convert ts from milli to nano seconds.
+		ts *= 1e+6
+		if hasNanos {
+			ts = nanos.TimestampNano()
+		}
+		for _, s := range vec {
+			if math.IsNaN(s.V) || math.IsInf(s.V, 0) {
+				continue
+			}
+			line = append(line[:0], name...)
+			for _, l := range s.Metric {
+				// the line protocol does not support empty tag values.
+				if l.Value == "" {
+					continue
+				}
+				line = append(line, ',')
+				line = append(line, tagEscaper.Replace(l.Name)...)
+				line = append(line, '=')
+				line = append(line, tagEscaper.Replace(l.Value)...)
+			}
+			line = append(line, " value="...)
+			line = strconv.AppendFloat(line, s.V, 'f', -1, 64)
+			line = append(line, ' ')
+			line = strconv.AppendInt(line, ts, 10)
+			line = append(line, '\n')
+			if _, err := w.Write(line); err != nil {
+				return err
+			}
+		}
+	}
+	return it.Error()
+}
+
+// EncodeDeltaStream writes the aggregated steps of the iterator as a compact binary stream, series
+// by series, for slowly changing series. The stream starts with the amount of series, then each
+// series has its labels followed by its points, as the delta from the previous timestamp and
+// the delta from the previous value. Values deltas are the XOR of their bits, exact unlike a
+// subtraction, so that unchanged values take a single byte. Integers are varint encoded.
+// Series are buffered, as steps are. The iterator is consumed but not closed.
+// The stream is read back by DecodeDeltaStream.
+func EncodeDeltaStream(w io.Writer, it RangeVectorIterator, agg RangeVectorAggregator) error {
+	m, err := EvalToMatrix(it, agg, 0)
+	if err != nil {
+		return err
+	}
+	var (
+		bw  = bufio.NewWriter(w)
+		buf [binary.MaxVarintLen64]byte
+	)
+	writeUvarint := func(x uint64) {
+		n := binary.PutUvarint(buf[:], x)
+		_, _ = bw.Write(buf[:n])
+	}
+	writeString := func(s string) {
+		writeUvarint(uint64(len(s)))
+		_, _ = bw.WriteString(s)
+	}
+	writeUvarint(uint64(len(m)))
+	for _, series := range m {
+		writeUvarint(uint64(len(series.Metric)))
+		for _, l := range series.Metric {
+			writeString(l.Name)
+			writeString(l.Value)
+		}
+		writeUvarint(uint64(len(series.Points)))
+		var (
+			prevT    int64
+			prevBits uint64
+		)
+		for _, p := range series.Points {
+			n := binary.PutVarint(buf[:], p.T-prevT)
+			_, _ = bw.Write(buf[:n])
+			// reversed, the sign, exponent and high mantissa bits changing the most come first.
+			valueBits := math.Float64bits(p.V)
+			writeUvarint(bits.Reverse64(valueBits ^ prevBits))
+			prevT, prevBits = p.T, valueBits
+		}
+	}
+	// a buffered writer keeps the first error, returned by Flush.
+	return bw.Flush()
+}
+
+// DecodeDeltaStream reads back a stream written by EncodeDeltaStream as a matrix.
+func DecodeDeltaStream(r io.Reader) (promql.Matrix, error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	readString := func() (string, error) {
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return "", err
+		}
+		// lengths are not trusted for allocations, the stream could be corrupted.
+		var b strings.Builder
+		for ; n > 0; n-- {
+			c, err := br.ReadByte()
+			if err != nil {
+				return "", err
+			}
+			b.WriteByte(c)
+		}
+		return b.String(), nil
+	}
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	var m promql.Matrix
+	for ; count > 0; count-- {
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		series := promql.Series{Metric: labels.Labels{}}
+		for ; n > 0; n-- {
+			var l labels.Label
+			if l.Name, err = readString(); err != nil {
+				return nil, err
+			}
+			if l.Value, err = readString(); err != nil {
+				return nil, err
+			}
+			series.Metric = append(series.Metric, l)
+		}
+		if n, err = binary.ReadUvarint(br); err != nil {
+			return nil, err
+		}
+		var (
+			prevT    int64
+			prevBits uint64
+		)
+		for ; n > 0; n-- {
+			dt, err := binary.ReadVarint(br)
+			if err != nil {
+				return nil, err
+			}
+			dv, err := binary.ReadUvarint(br)
+			if err != nil {
+				return nil, err
+			}
+			prevT, prevBits = prevT+dt, prevBits^bits.Reverse64(dv)
+			series.Points = append(series.Points, promql.Point{T: prevT, V: math.Float64frombits(prevBits)})
+		}
+		m = append(m, series)
+	}
+	return m, nil
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,131 @@
+package logql
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/stretchr/testify/require"
+)
+
+// newDropOutIterator returns a range vector iterator over 3 steps of one second where
+// the bar series is only present in the first step.
+func newDropOutIterator() RangeVectorIterator {
+	return newRangeVectorIterator(newSliceSeriesIterator(
+		Sample{Labels: `{app="bar"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 2},
+		Sample{Labels: `{app="foo", env="prod"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 1},
+		Sample{Labels: `{app="foo", env="prod"}`, TimestampNano: time.Unix(2, 0).UnixNano(), Value: 1.5},
+		Sample{Labels: `{app="foo", env="prod"}`, TimestampNano: time.Unix(3, 0).UnixNano(), Value: 3},
+	), time.Second.Nanoseconds(), time.Second.Nanoseconds(), time.Unix(1, 0).UnixNano(), time.Unix(3, 0).UnixNano())
+}
+
+func Test_EncodeCSV(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, EncodeCSV(&buf, newDropOutIterator(), sumOverTime))
+	require.Equal(t, `timestamp,"{app=""bar""}","{app=""foo"", env=""prod""}"
+1000,2,1
+2000,,1.5
+3000,,3
+`, buf.String())
+}
+
+func Test_EncodeArrow(t *testing.T) {
+	it := newRangeVectorIterator(newSliceSeriesIterator(
+		Sample{Labels: `{app="bar"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 2},
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 1},
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(2, 0).UnixNano(), Value: 1.5},
+		Sample{Labels: `{app="baz"}`, TimestampNano: time.Unix(3, 0).UnixNano(), Value: 4},
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(3, 0).UnixNano(), Value: 3},
+	), time.Second.Nanoseconds(), time.Second.Nanoseconds(), time.Unix(1, 0).UnixNano(), time.Unix(3, 0).UnixNano())
+
+	rec, err := EncodeArrow(it, sumOverTime)
+	require.NoError(t, err)
+	defer rec.Release()
+
+	require.Equal(t, int64(3), rec.NumCols())
+	require.Equal(t, int64(5), rec.NumRows())
+	require.Equal(t, []string{"timestamp", "labels", "value"}, []string{rec.ColumnName(0), rec.ColumnName(1), rec.ColumnName(2)})
+	require.Equal(t, []arrow.Timestamp{1000, 1000, 2000, 3000, 3000}, rec.Column(0).(*array.Timestamp).TimestampValues())
+	require.Equal(t, []int32{0, 1, 1, 2, 1}, rec.Column(1).(*array.Int32).Int32Values())
+	require.Equal(t, []float64{2, 1, 1.5, 4, 3}, rec.Column(2).(*array.Float64).Float64Values())
+
+	dictionary := rec.Schema().Field(1).Metadata
+	require.Equal(t, []string{"0", "1", "2"}, dictionary.Keys())
+	require.Equal(t, []string{`{app="bar"}`, `{app="foo"}`, `{app="baz"}`}, dictionary.Values())
+}
+
+func Test_EncodeLineProtocol(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, EncodeLineProtocol(&buf, newDropOutIterator(), sumOverTime, "log rate"))
+	require.Equal(t, `log\ rate,app=bar value=2 1000000000
+log\ rate,app=foo,env=prod value=1 1000000000
+log\ rate,app=foo,env=prod value=1.5 2000000000
+log\ rate,app=foo,env=prod value=3 3000000000
+`, sortLines(buf.String()))
+
+	buf.Reset()
+	it := newRangeVectorIterator(newSliceSeriesIterator(
+		Sample{Labels: `{path="/a,b", query="x=1 y"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 4},
+	), time.Second.Nanoseconds(), time.Second.Nanoseconds(), time.Unix(1, 0).UnixNano(), time.Unix(1, 0).UnixNano())
+	require.NoError(t, EncodeLineProtocol(&buf, it, sumOverTime, "logs"))
+	require.Equal(t, `logs,path=/a\,b,query=x\=1\ y value=4 1000000000
+`, buf.String())
+
+	// NaN and infinite values cannot be written.
+	for _, v := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		buf.Reset()
+		require.NoError(t, EncodeLineProtocol(&buf, newDropOutIterator(), func([]promql.Point) float64 { return v }, "logs"))
+		require.Empty(t, buf.String())
+	}
+
+	// timestamps keep the nanoseconds precision of the iterator.
+	buf.Reset()
+	it = newRangeVectorIterator(newSliceSeriesIterator(
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(1, 5).UnixNano(), Value: 4},
+	), time.Second.Nanoseconds(), time.Second.Nanoseconds(), time.Unix(1, 5).UnixNano(), time.Unix(1, 5).UnixNano())
+	require.NoError(t, EncodeLineProtocol(&buf, it, sumOverTime, "logs"))
+	require.Equal(t, "logs,app=foo value=4 1000000005\n", buf.String())
+}
+
+// sortLines sorts lines, as series within a step are not ordered.
+func sortLines(s string) string {
+	lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	sort.Strings(lines)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func Test_EncodeDeltaStream(t *testing.T) {
+	expected, err := EvalToMatrix(newDropOutIterator(), sumOverTime, 0)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, EncodeDeltaStream(&buf, newDropOutIterator(), sumOverTime))
+	m, err := DecodeDeltaStream(&buf)
+	require.NoError(t, err)
+	require.Equal(t, expected, m)
+
+	// unchanged values take a single byte.
+	it := &vectorsIterator{ts: make([]int64, 100), vectors: make([]promql.Vector, 100)}
+	for i := range it.vectors {
+		it.ts[i] = int64(i) * 1000
+		it.vectors[i] = promql.Vector{{Metric: labels.Labels{{Name: "app", Value: "foo"}}, Point: promql.Point{V: 0.1}}}
+	}
+	buf.Reset()
+	require.NoError(t, EncodeDeltaStream(&buf, it, sumOverTime))
+	require.Less(t, buf.Len(), 100*4)
+	m, err = DecodeDeltaStream(&buf)
+	require.NoError(t, err)
+	require.Len(t, m, 1)
+	require.Len(t, m[0].Points, 100)
+	require.Equal(t, promql.Point{T: 99000, V: 0.1}, m[0].Points[99])
+
+	_, err = DecodeDeltaStream(bytes.NewReader([]byte{1, 1}))
+	require.Error(t, err)
+}
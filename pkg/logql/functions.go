@@ -1,7 +1,10 @@
 package logql
 
 import (
+	"container/heap"
 	"fmt"
+	"math"
+	"sort"
 	"time"
 
 	"github.com/prometheus/prometheus/promql"
@@ -20,21 +23,30 @@ func (r rangeAggregationExpr) extractor() (SampleExtractor, error) {
 	}
 }
 
-func (r rangeAggregationExpr) aggregator() (RangeVectorAggregator, error) {
+// aggregator returns the aggregator of the operation along with the unit of its results.
+func (r rangeAggregationExpr) aggregator() (RangeVectorAggregator, string, error) {
 	switch r.operation {
 	case OpRangeTypeRate:
-		return rateLogs(r.left.interval), nil
+		return rateLogs(r.left.interval), UnitPerSecond, nil
 	case OpRangeTypeCount:
-		return countOverTime, nil
+		return countOverTime, UnitCount, nil
 	case OpRangeTypeBytesRate:
-		return rateLogBytes(r.left.interval), nil
+		return rateLogBytes(r.left.interval), UnitBytesPerSecond, nil
 	case OpRangeTypeBytes:
-		return sumOverTime, nil
+		return sumOverTime, UnitBytes, nil
 	default:
-		return nil, fmt.Errorf(unsupportedErr, r.operation)
+		return nil, "", fmt.Errorf(unsupportedErr, r.operation)
 	}
 }
 
+// Units of the range vector aggregations, hints for clients to format the results.
+const (
+	UnitCount          = "count"
+	UnitBytes          = "bytes"
+	UnitPerSecond      = "per-second"
+	UnitBytesPerSecond = "bytes-per-second"
+)
+
 // rateLogs calculates the per-second rate of log lines.
 func rateLogs(selRange time.Duration) func(samples []promql.Point) float64 {
 	return func(samples []promql.Point) float64 {
@@ -61,3 +73,492 @@ func sumOverTime(samples []promql.Point) float64 {
 	}
 	return sum
 }
+
+// OutlierCountOverTime counts the samples exceeding the window mean by more than k standard deviations.
+// Windows with less than two samples have no meaningful deviation and return 0.
+func OutlierCountOverTime(k float64) RangeVectorAggregator {
+	return func(samples []promql.Point) float64 {
+		if len(samples) < 2 {
+			return 0
+		}
+		mean, m2 := meanAndSquaredDeviations(samples)
+		threshold := mean + k*math.Sqrt(m2/float64(len(samples)))
+		var count float64
+		for _, p := range samples {
+			if p.V > threshold {
+				count++
+			}
+		}
+		return count
+	}
+}
+
+// meanAndSquaredDeviations returns the mean of the samples and the sum of their squared
+// deviations from it, in a single pass using Welford's algorithm.
+func meanAndSquaredDeviations(samples []promql.Point) (mean, m2 float64) {
+	for i, p := range samples {
+		delta := p.V - mean
+		mean += delta / float64(i+1)
+		m2 += delta * (p.V - mean)
+	}
+	return mean, m2
+}
+
+// RatioToConstant divides the result of the aggregator by a constant denominator.
+// Like the division binary operation, a zero denominator results in NaN.
+func RatioToConstant(denominator float64, agg RangeVectorAggregator) RangeVectorAggregator {
+	return func(samples []promql.Point) float64 {
+		// guard against divide by zero
+		if denominator == 0 {
+			return math.NaN()
+		}
+		return agg(samples) / denominator
+	}
+}
+
+// TrimmedMeanOverTime averages the window values after dropping the lowest and highest
+// trimFraction of them. The fraction is clamped to [0,0.5) and windows too small to be trimmed
+// fall back to the plain mean.
+func TrimmedMeanOverTime(trimFraction float64) RangeVectorAggregator {
+	if trimFraction < 0 {
+		trimFraction = 0
+	}
+	return func(samples []promql.Point) float64 {
+		if len(samples) == 0 {
+			return math.NaN()
+		}
+		trim := int(float64(len(samples)) * trimFraction)
+		// always keep at least one value.
+		if limit := (len(samples) - 1) / 2; trim > limit {
+			trim = limit
+		}
+		values := sortedValues(samples)
+		var sum float64
+		for _, v := range values[trim : len(values)-trim] {
+			sum += v
+		}
+		return sum / float64(len(values)-2*trim)
+	}
+}
+
+// sortedValues returns a sorted copy of the samples values, leaving samples untouched.
+func sortedValues(samples []promql.Point) []float64 {
+	values := make([]float64, 0, len(samples))
+	for _, p := range samples {
+		values = append(values, p.V)
+	}
+	sort.Float64s(values)
+	return values
+}
+
+// AutocorrelationOverTime computes the correlation between the window values and the same values
+// shifted by lag samples. Windows without more samples than the lag, or without any variation, return NaN.
+func AutocorrelationOverTime(lag int) RangeVectorAggregator {
+	return func(samples []promql.Point) float64 {
+		if lag < 0 || len(samples) <= lag {
+			return math.NaN()
+		}
+		var mean float64
+		for _, p := range samples {
+			mean += p.V
+		}
+		mean /= float64(len(samples))
+		var covariance, variance float64
+		for i, p := range samples {
+			variance += (p.V - mean) * (p.V - mean)
+			if i+lag < len(samples) {
+				covariance += (p.V - mean) * (samples[i+lag].V - mean)
+			}
+		}
+		if variance == 0 {
+			return math.NaN()
+		}
+		return covariance / variance
+	}
+}
+
+// NthLargestOverTime returns the n-th largest value of the window, 1 being the maximum.
+// It keeps a heap of the n largest values instead of sorting the window.
+// Windows with less than n samples return NaN.
+func NthLargestOverTime(n int) RangeVectorAggregator {
+	return func(samples []promql.Point) float64 {
+		if n < 1 || len(samples) < n {
+			return math.NaN()
+		}
+		largest := make(valueHeap, 0, n)
+		for _, p := range samples {
+			if len(largest) < n {
+				heap.Push(&largest, p.V)
+				continue
+			}
+			// NaN ranks lowest, it is replaced by any value.
+			if p.V > largest[0] || math.IsNaN(largest[0]) {
+				largest[0] = p.V
+				heap.Fix(&largest, 0)
+			}
+		}
+		return largest[0]
+	}
+}
+
+// ValueAtTimeQuantile returns the value at the q-quantile of the time between the first and the
+// last samples of the window, interpolating linearly between the samples straddling it.
+// The quantile is clamped to [0,1], 0 being the first value and 1 the last one.
+func ValueAtTimeQuantile(q float64) RangeVectorAggregator {
+	q = math.Max(0, math.Min(1, q))
+	return func(samples []promql.Point) float64 {
+		if len(samples) == 0 {
+			return math.NaN()
+		}
+		first, last := samples[0], samples[len(samples)-1]
+		return interpolate(samples, float64(first.T)+q*float64(last.T-first.T))
+	}
+}
+
+// interpolate returns the value at time t, linearly interpolated between the time ordered
+// samples straddling it.
+func interpolate(samples []promql.Point, t float64) float64 {
+	// first sample at or after t.
+	i := sort.Search(len(samples), func(i int) bool {
+		return float64(samples[i].T) >= t
+	})
+	if i == len(samples) {
+		return samples[len(samples)-1].V
+	}
+	if i == 0 || float64(samples[i].T) == t {
+		return samples[i].V
+	}
+	prev, next := samples[i-1], samples[i]
+	return prev.V + (next.V-prev.V)*(t-float64(prev.T))/float64(next.T-prev.T)
+}
+
+// GiniOverTime computes the Gini coefficient of the window values, from 0 when all values are
+// equal to nearly 1 when a single value holds the whole total. It is undefined for negative values.
+// Empty windows return NaN.
+func GiniOverTime() RangeVectorAggregator {
+	return func(samples []promql.Point) float64 {
+		if len(samples) == 0 {
+			return math.NaN()
+		}
+		values := sortedValues(samples)
+		var sum, weighted float64
+		for i, v := range values {
+			sum += v
+			weighted += float64(i+1) * v
+		}
+		if sum == 0 {
+			return 0
+		}
+		n := float64(len(values))
+		return 2*weighted/(n*sum) - (n+1)/n
+	}
+}
+
+// TimestampOverTime returns the timestamp in seconds of the most recent sample of the window.
+func TimestampOverTime() RangeVectorAggregator {
+	return func(samples []promql.Point) float64 {
+		if len(samples) == 0 {
+			return math.NaN()
+		}
+		// window points timestamps are in nanoseconds.
+		return float64(samples[len(samples)-1].T) / 1e+9
+	}
+}
+
+// TimeAboveThreshold returns the fraction of the sampled span, from the first to the last sample
+// of the window, the value linearly interpolated between consecutive samples spent above the
+// threshold. This is not a fraction of the window range: aggregators don't know the window bounds,
+// the time before the first and after the last sample is not accounted for. Windows spanning no
+// time return 1 when their value is above, else 0.
+func TimeAboveThreshold(threshold float64) RangeVectorAggregator {
+	return func(samples []promql.Point) float64 {
+		if len(samples) == 0 {
+			return math.NaN()
+		}
+		span := samples[len(samples)-1].T - samples[0].T
+		if span == 0 {
+			if samples[0].V > threshold {
+				return 1
+			}
+			return 0
+		}
+		var above float64
+		for i := 1; i < len(samples); i++ {
+			prev, cur := samples[i-1], samples[i]
+			dt := float64(cur.T - prev.T)
+			switch {
+			case prev.V > threshold && cur.V > threshold:
+				above += dt
+			case prev.V > threshold:
+				// crossing downward, above until the crossing.
+				above += dt * (prev.V - threshold) / (prev.V - cur.V)
+			case cur.V > threshold:
+				// crossing upward, above from the crossing.
+				above += dt * (cur.V - threshold) / (cur.V - prev.V)
+			}
+		}
+		return above / float64(span)
+	}
+}
+
+// minDFTSamples is the minimum amount of samples to detect a frequency.
+const minDFTSamples = 4
+
+// DominantFrequencyOverTime returns the frequency in hertz with the highest magnitude in the
+// discrete Fourier transform of the window values, ignoring the constant component.
+// Samples are first resampled, by linear interpolation, to as many evenly spaced points between
+// the first and the last sample. Windows with less than 4 samples return NaN.
+func DominantFrequencyOverTime() RangeVectorAggregator {
+	return func(samples []promql.Point) float64 {
+		n := len(samples)
+		if n < minDFTSamples || samples[n-1].T == samples[0].T {
+			return math.NaN()
+		}
+		// window points timestamps are in nanoseconds.
+		interval := float64(samples[n-1].T-samples[0].T) / float64(n-1)
+		values := make([]float64, n)
+		for i := range values {
+			values[i] = interpolate(samples, float64(samples[0].T)+float64(i)*interval)
+		}
+		var (
+			dominant     int
+			maxMagnitude float64
+		)
+		// bins above n/2 mirror the lower ones for real values.
+		for k := 1; k <= n/2; k++ {
+			var re, im float64
+			for i, v := range values {
+				angle := 2 * math.Pi * float64(k*i) / float64(n)
+				re += v * math.Cos(angle)
+				im -= v * math.Sin(angle)
+			}
+			if magnitude := math.Hypot(re, im); magnitude > maxMagnitude {
+				dominant, maxMagnitude = k, magnitude
+			}
+		}
+		return float64(dominant) / (float64(n) * interval / 1e+9)
+	}
+}
+
+// WrappingCounterRate calculates the per-second rate of a counter wrapping around at maxValue,
+// like fixed-width hardware counters. A decrease is a wrap: the counter went up to maxValue
+// before restarting from zero, unlike a reset. The range is in nanoseconds.
+func WrappingCounterRate(selRange, maxValue int64) RangeVectorAggregator {
+	return func(samples []promql.Point) float64 {
+		var increase float64
+		for i := 1; i < len(samples); i++ {
+			prev, cur := samples[i-1].V, samples[i].V
+			if cur < prev {
+				increase += float64(maxValue) - prev + cur
+				continue
+			}
+			increase += cur - prev
+		}
+		return increase / time.Duration(selRange).Seconds()
+	}
+}
+
+// DynamicRangeOverTime returns the ratio of the window max to its min, surfacing order of
+// magnitude swings. Like the division binary operation, a zero min results in NaN.
+// With negative values the ratio is not meaningful: it is negative or smaller than 1.
+// Single value windows return 1 and empty windows NaN.
+func DynamicRangeOverTime() RangeVectorAggregator {
+	return func(samples []promql.Point) float64 {
+		if len(samples) == 0 {
+			return math.NaN()
+		}
+		min, max := samples[0].V, samples[0].V
+		for _, v := range samples[1:] {
+			min = math.Min(min, v.V)
+			max = math.Max(max, v.V)
+		}
+		// guard against divide by zero
+		if min == 0 {
+			return math.NaN()
+		}
+		return max / min
+	}
+}
+
+// CounterRateWithGapReset calculates the per-second rate of a counter, where like Prometheus a
+// decrease is a reset of the counter. When consecutive samples are more than maxGap apart, the
+// value after the gap is a fresh start of the counter instead, so it does not add to the
+// increase. The range and the gap are in nanoseconds.
+func CounterRateWithGapReset(selRange, maxGap int64) RangeVectorAggregator {
+	return func(samples []promql.Point) float64 {
+		var increase float64
+		for i := 1; i < len(samples); i++ {
+			prev, cur := samples[i-1], samples[i]
+			switch {
+			case cur.T-prev.T > maxGap:
+			case cur.V < prev.V:
+				increase += cur.V
+			default:
+				increase += cur.V - prev.V
+			}
+		}
+		return increase / time.Duration(selRange).Seconds()
+	}
+}
+
+// ResetsOverTime counts the decreases between consecutive window values, like the Prometheus
+// resets function.
+func ResetsOverTime() RangeVectorAggregator {
+	return func(samples []promql.Point) float64 {
+		var resets float64
+		for i := 1; i < len(samples); i++ {
+			if samples[i].V < samples[i-1].V {
+				resets++
+			}
+		}
+		return resets
+	}
+}
+
+// IncreasesOverTime counts the increases between consecutive window values.
+func IncreasesOverTime() RangeVectorAggregator {
+	return func(samples []promql.Point) float64 {
+		var increases float64
+		for i := 1; i < len(samples); i++ {
+			if samples[i].V > samples[i-1].V {
+				increases++
+			}
+		}
+		return increases
+	}
+}
+
+// MADOverTime returns the median absolute deviation of the window values, the median of their
+// distances to the median, which unlike the standard deviation is robust to outliers.
+// Empty windows return NaN.
+func MADOverTime() RangeVectorAggregator {
+	return func(samples []promql.Point) float64 {
+		if len(samples) == 0 {
+			return math.NaN()
+		}
+		values := sortedValues(samples)
+		m := median(values)
+		for i, v := range values {
+			values[i] = math.Abs(v - m)
+		}
+		sort.Float64s(values)
+		return median(values)
+	}
+}
+
+// median returns the median of sorted values.
+func median(values []float64) float64 {
+	n := len(values)
+	if n%2 == 0 {
+		return (values[n/2-1] + values[n/2]) / 2
+	}
+	return values[n/2]
+}
+
+// centralMoments accumulates in a single pass the sums of the second, third and fourth powers
+// of the deviations of the samples values to their mean.
+func centralMoments(samples []promql.Point) (m2, m3, m4 float64) {
+	var mean float64
+	for i, p := range samples {
+		n := float64(i + 1)
+		delta := p.V - mean
+		deltaN := delta / n
+		deltaN2 := deltaN * deltaN
+		term := delta * deltaN * (n - 1)
+		mean += deltaN
+		m4 += term*deltaN2*(n*n-3*n+3) + 6*deltaN2*m2 - 4*deltaN*m3
+		m3 += term*deltaN*(n-2) - 3*deltaN*m2
+		m2 += term
+	}
+	return m2, m3, m4
+}
+
+// SkewnessOverTime returns the skewness of the window values, their third standardized moment.
+// Windows with less than 3 values, or without any variation, return NaN.
+func SkewnessOverTime() RangeVectorAggregator {
+	return func(samples []promql.Point) float64 {
+		m2, m3, _ := centralMoments(samples)
+		if len(samples) < 3 || m2 == 0 {
+			return math.NaN()
+		}
+		return math.Sqrt(float64(len(samples))) * m3 / math.Pow(m2, 1.5)
+	}
+}
+
+// KurtosisOverTime returns the excess kurtosis of the window values, their fourth standardized
+// moment minus 3 so that normally distributed values have a zero kurtosis.
+// Windows with less than 4 values, or without any variation, return NaN.
+func KurtosisOverTime() RangeVectorAggregator {
+	return func(samples []promql.Point) float64 {
+		m2, _, m4 := centralMoments(samples)
+		if len(samples) < 4 || m2 == 0 {
+			return math.NaN()
+		}
+		return float64(len(samples))*m4/(m2*m2) - 3
+	}
+}
+
+// minFlatlineSamples is the minimum amount of samples to detect a flatline.
+const minFlatlineSamples = 3
+
+// IsFlatlineOverTime returns 1 if all the window values are within epsilon of each other, e.g a
+// stuck sensor, and 0 otherwise. Windows with less than 3 samples are not flatlines.
+func IsFlatlineOverTime(epsilon float64) RangeVectorAggregator {
+	return func(samples []promql.Point) float64 {
+		if len(samples) < minFlatlineSamples {
+			return 0
+		}
+		min, max := samples[0].V, samples[0].V
+		for _, v := range samples[1:] {
+			min = math.Min(min, v.V)
+			max = math.Max(max, v.V)
+		}
+		if max-min <= epsilon {
+			return 1
+		}
+		return 0
+	}
+}
+
+// LongestRunAboveThreshold returns the amount of samples of the longest run of consecutive
+// window values above the threshold, e.g to estimate how long an incident lasted.
+func LongestRunAboveThreshold(threshold float64) RangeVectorAggregator {
+	return func(samples []promql.Point) float64 {
+		var current, longest int
+		for _, p := range samples {
+			if p.V <= threshold {
+				current = 0
+				continue
+			}
+			current++
+			if current > longest {
+				longest = current
+			}
+		}
+		return float64(longest)
+	}
+}
+
+// LongestRunDurationAboveThreshold is like LongestRunAboveThreshold but returns the duration in
+// seconds of the longest run, from its first to its last sample. Single sample runs last 0s.
+func LongestRunDurationAboveThreshold(threshold float64) RangeVectorAggregator {
+	return func(samples []promql.Point) float64 {
+		var (
+			start   = -1
+			longest int64
+		)
+		for i, p := range samples {
+			if p.V <= threshold {
+				start = -1
+				continue
+			}
+			if start < 0 {
+				start = i
+			}
+			if d := p.T - samples[start].T; d > longest {
+				longest = d
+			}
+		}
+		return time.Duration(longest).Seconds()
+	}
+}
@@ -0,0 +1,224 @@
+package logql
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/promql"
+	"github.com/stretchr/testify/require"
+)
+
+func newPoints(values ...float64) []promql.Point {
+	points := make([]promql.Point, 0, len(values))
+	for i, v := range values {
+		points = append(points, promql.Point{T: int64(i+1) * 1e9, V: v})
+	}
+	return points
+}
+
+func Test_OutlierCountOverTime(t *testing.T) {
+	require.Equal(t, 1., OutlierCountOverTime(2)(newPoints(1, 1, 1, 1, 1, 1, 1, 1, 1, 100)))
+	require.Equal(t, 0., OutlierCountOverTime(2)(newPoints(1, 2, 1, 2)))
+	require.Equal(t, 0., OutlierCountOverTime(2)(newPoints(100)))
+	require.Equal(t, 0., OutlierCountOverTime(2)(nil))
+}
+
+func Test_RatioToConstant(t *testing.T) {
+	require.Equal(t, 0.05, RatioToConstant(100, countOverTime)(newPoints(1, 1, 1, 1, 1)))
+	require.True(t, math.IsNaN(RatioToConstant(0, countOverTime)(newPoints(1, 1))))
+}
+
+func Test_TrimmedMeanOverTime(t *testing.T) {
+	points := newPoints(1000, 2, 3, 4, 5, 6, 7, 8, 9, -1000)
+	require.Equal(t, 5.5, TrimmedMeanOverTime(0.1)(points))
+	// points are not mutated.
+	require.Equal(t, 1000., points[0].V)
+	require.Equal(t, -1000., points[9].V)
+	// no trimming and too small windows are the plain mean.
+	require.Equal(t, 4.4, TrimmedMeanOverTime(0)(points))
+	require.Equal(t, 2., TrimmedMeanOverTime(0.2)(newPoints(1, 3)))
+	// fractions are clamped.
+	require.Equal(t, 3., TrimmedMeanOverTime(0.9)(newPoints(1, 2, 3, 100, 200)))
+	require.True(t, math.IsNaN(TrimmedMeanOverTime(0.1)(nil)))
+}
+
+func Test_AutocorrelationOverTime(t *testing.T) {
+	// period of 4 samples.
+	var values []float64
+	for i := 0; i < 10; i++ {
+		values = append(values, 0, 1, 0, -1)
+	}
+	points := newPoints(values...)
+	require.InDelta(t, 0.9, AutocorrelationOverTime(4)(points), 0.01)
+	require.InDelta(t, 0., AutocorrelationOverTime(1)(points), 0.01)
+	require.InDelta(t, -0.95, AutocorrelationOverTime(2)(points), 0.01)
+	require.InDelta(t, 1., AutocorrelationOverTime(0)(points), 0.01)
+
+	require.True(t, math.IsNaN(AutocorrelationOverTime(4)(newPoints(1, 2, 3, 4))))
+	require.True(t, math.IsNaN(AutocorrelationOverTime(1)(newPoints(1, 1, 1))))
+}
+
+func Test_NthLargestOverTime(t *testing.T) {
+	points := newPoints(3, 1, 1000, 7, 5, 2)
+	require.Equal(t, 1000., NthLargestOverTime(1)(points))
+	require.Equal(t, 7., NthLargestOverTime(2)(points))
+	require.Equal(t, 1., NthLargestOverTime(6)(points))
+	require.True(t, math.IsNaN(NthLargestOverTime(7)(points)))
+	require.True(t, math.IsNaN(NthLargestOverTime(1)(nil)))
+
+	points = newPoints(math.NaN(), 5, 7)
+	require.Equal(t, 7., NthLargestOverTime(1)(points))
+	require.Equal(t, 5., NthLargestOverTime(2)(points))
+}
+
+func Test_ValueAtTimeQuantile(t *testing.T) {
+	points := newPoints(10, 20, 30, 40, 50)
+	require.Equal(t, 10., ValueAtTimeQuantile(0)(points))
+	require.Equal(t, 50., ValueAtTimeQuantile(1)(points))
+	require.Equal(t, 30., ValueAtTimeQuantile(0.5)(points))
+	require.InDelta(t, 46., ValueAtTimeQuantile(0.9)(points), 1e-9)
+	require.Equal(t, 7., ValueAtTimeQuantile(0.5)(newPoints(7)))
+	require.True(t, math.IsNaN(ValueAtTimeQuantile(0.5)(nil)))
+}
+
+func Test_GiniOverTime(t *testing.T) {
+	require.Equal(t, 0., GiniOverTime()(newPoints(5, 5, 5, 5)))
+	skewed := make([]float64, 100)
+	skewed[42] = 1000
+	points := newPoints(skewed...)
+	require.InDelta(t, 0.99, GiniOverTime()(points), 1e-9)
+	// points are not mutated.
+	require.Equal(t, 1000., points[42].V)
+	require.InDelta(t, 0.25, GiniOverTime()(newPoints(1, 3)), 1e-9)
+	require.Equal(t, 0., GiniOverTime()(newPoints(3)))
+	require.True(t, math.IsNaN(GiniOverTime()(nil)))
+}
+
+func Test_TimestampOverTime(t *testing.T) {
+	points := []promql.Point{{T: 10e9, V: 1}, {T: 15e9, V: 4}, {T: 22.5e9, V: 2}}
+	require.Equal(t, 22.5, TimestampOverTime()(points))
+	require.Equal(t, 10., TimestampOverTime()(points[:1]))
+	require.True(t, math.IsNaN(TimestampOverTime()(nil)))
+}
+
+func Test_TimeAboveThreshold(t *testing.T) {
+	// crosses 10 upward half way between the 2nd and 3rd samples.
+	require.InDelta(t, 0.625, TimeAboveThreshold(10)(newPoints(0, 5, 15, 20, 20)), 1e-9)
+	// crosses upward then downward.
+	require.InDelta(t, 0.5, TimeAboveThreshold(10)(newPoints(0, 20, 0)), 1e-9)
+	require.Equal(t, 1., TimeAboveThreshold(10)(newPoints(11, 12, 13)))
+	require.Equal(t, 0., TimeAboveThreshold(10)(newPoints(1, 10, 3)))
+	require.Equal(t, 1., TimeAboveThreshold(10)(newPoints(11)))
+	require.True(t, math.IsNaN(TimeAboveThreshold(10)(nil)))
+	// the fraction is of the sampled span, a window sampled only in its last second is fully above.
+	require.Equal(t, 1., TimeAboveThreshold(10)([]promql.Point{{T: 9e9, V: 11}, {T: 10e9, V: 12}}))
+}
+
+func Test_DominantFrequencyOverTime(t *testing.T) {
+	// a 0.1Hz sinusoid sampled every second.
+	values := make([]float64, 100)
+	for i := range values {
+		values[i] = 5 + math.Sin(2*math.Pi*0.1*float64(i))
+	}
+	require.InDelta(t, 0.1, DominantFrequencyOverTime()(newPoints(values...)), 1e-9)
+
+	// unevenly spaced samples are resampled.
+	points := newPoints(values...)
+	points = append(points[:10:10], points[11:]...)
+	require.InDelta(t, 0.1, DominantFrequencyOverTime()(points), 0.01)
+
+	require.True(t, math.IsNaN(DominantFrequencyOverTime()(newPoints(1, 2, 3))))
+}
+
+func Test_WrappingCounterRate(t *testing.T) {
+	rate := WrappingCounterRate((10 * time.Second).Nanoseconds(), math.MaxUint32)
+	require.Equal(t, 2., rate(newPoints(0, 10, 20)))
+	// wraps from 4294967290 to 10.
+	require.Equal(t, 2.5, rate(newPoints(4294967280, 4294967290, 10)))
+	require.Equal(t, 0., rate(newPoints(5)))
+}
+
+func Test_DynamicRangeOverTime(t *testing.T) {
+	require.Equal(t, 100., DynamicRangeOverTime()(newPoints(5, 2, 200, 50, 10)))
+	require.Equal(t, 1., DynamicRangeOverTime()(newPoints(7)))
+	require.True(t, math.IsNaN(DynamicRangeOverTime()(newPoints(0, 10))))
+	require.True(t, math.IsNaN(DynamicRangeOverTime()(nil)))
+}
+
+func Test_CounterRateWithGapReset(t *testing.T) {
+	rate := CounterRateWithGapReset((10 * time.Second).Nanoseconds(), (5 * time.Second).Nanoseconds())
+	require.Equal(t, 2., rate(newPoints(0, 10, 20)))
+	// reset from 20 to 5.
+	require.Equal(t, 2.5, rate(newPoints(0, 10, 20, 5)))
+
+	// the stream resumes at 500 after a 30s silence.
+	points := append(newPoints(0, 10, 20), promql.Point{T: 33e9, V: 500}, promql.Point{T: 34e9, V: 510})
+	require.Equal(t, 3., rate(points))
+	require.Equal(t, 0., rate(newPoints(5)))
+}
+
+func Test_ResetsAndIncreasesOverTime(t *testing.T) {
+	require.Equal(t, 2., ResetsOverTime()(newPoints(1, 2, 1, 3, 1)))
+	require.Equal(t, 2., IncreasesOverTime()(newPoints(1, 2, 1, 3, 1)))
+	require.Equal(t, 0., ResetsOverTime()(newPoints(1)))
+	require.Equal(t, 0., IncreasesOverTime()(nil))
+}
+
+func Test_MADOverTime(t *testing.T) {
+	stddev := func(points []promql.Point) float64 {
+		_, m2 := meanAndSquaredDeviations(points)
+		return math.Sqrt(m2 / float64(len(points)))
+	}
+	clean, outlier := newPoints(1, 2, 3, 4, 5), newPoints(1, 2, 3, 4, 100)
+	require.Equal(t, 1., MADOverTime()(clean))
+	// deviations to the median 3 are 2, 1, 0, 1 and 97.
+	require.Equal(t, 1., MADOverTime()(outlier))
+	require.Greater(t, stddev(outlier)-stddev(clean), 10.)
+	// points are left untouched.
+	require.Equal(t, 100., outlier[4].V)
+
+	// the median 3.5 is between two values.
+	require.Equal(t, 2., MADOverTime()(newPoints(1, 2, 5, 7)))
+	require.Equal(t, 0., MADOverTime()(newPoints(42)))
+	require.True(t, math.IsNaN(MADOverTime()(nil)))
+}
+
+func Test_SkewnessAndKurtosisOverTime(t *testing.T) {
+	// deviations to the mean 4 are -3, -2, -1 and 6, so that the second, third and fourth
+	// moments are 50/4, 180/4 and 1394/4.
+	points := newPoints(1, 2, 3, 10)
+	require.InDelta(t, 45/math.Pow(12.5, 1.5), SkewnessOverTime()(points), 1e-9)
+	require.InDelta(t, 348.5/(12.5*12.5)-3, KurtosisOverTime()(points), 1e-9)
+
+	// symmetric values.
+	require.InDelta(t, 0, SkewnessOverTime()(newPoints(1, 2, 3, 4, 5)), 1e-9)
+	require.InDelta(t, -1.3, KurtosisOverTime()(newPoints(1, 2, 3, 4, 5)), 1e-9)
+
+	require.True(t, math.IsNaN(SkewnessOverTime()(newPoints(1, 2))))
+	require.True(t, math.IsNaN(KurtosisOverTime()(newPoints(1, 2, 3))))
+	require.True(t, math.IsNaN(SkewnessOverTime()(newPoints(3, 3, 3, 3))))
+	require.True(t, math.IsNaN(KurtosisOverTime()(nil)))
+}
+
+func Test_IsFlatlineOverTime(t *testing.T) {
+	require.Equal(t, 1., IsFlatlineOverTime(0)(newPoints(4, 4, 4, 4)))
+	require.Equal(t, 1., IsFlatlineOverTime(0.1)(newPoints(4, 4.05, 3.98, 4)))
+	require.Equal(t, 0., IsFlatlineOverTime(0.1)(newPoints(4, 4.05, 5, 4)))
+	require.Equal(t, 0., IsFlatlineOverTime(0)(newPoints(4, 4)))
+	require.Equal(t, 0., IsFlatlineOverTime(0)(nil))
+}
+
+func Test_LongestRunAboveThreshold(t *testing.T) {
+	values := []float64{11, 12, 1, 15, 16, 17, 2, 20, 10}
+	require.Equal(t, 3., LongestRunAboveThreshold(10)(newPoints(values...)))
+	require.Equal(t, 0., LongestRunAboveThreshold(100)(newPoints(values...)))
+	require.Equal(t, 0., LongestRunAboveThreshold(10)(nil))
+
+	// the first run spans 2s with a single gap, longer than the 3 samples 1s apart.
+	points := []promql.Point{{T: 1e9, V: 11}, {T: 3e9, V: 12}, {T: 4e9, V: 1}, {T: 5e9, V: 15}, {T: 6e9, V: 16}, {T: 6.5e9, V: 17}}
+	require.Equal(t, 2., LongestRunDurationAboveThreshold(10)(points))
+	require.Equal(t, 3., LongestRunAboveThreshold(10)(points))
+	require.Equal(t, 0., LongestRunDurationAboveThreshold(10)(newPoints(11)))
+	require.Equal(t, 0., LongestRunDurationAboveThreshold(10)(nil))
+}
@@ -1,8 +1,11 @@
 package logql
 
 import (
+	"fmt"
+	"sort"
 	"time"
 
+	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/promql"
 )
 
@@ -67,3 +70,154 @@ func (m *MatrixStepper) Next() (bool, int64, promql.Vector) {
 func (m *MatrixStepper) Close() error { return nil }
 
 func (m *MatrixStepper) Error() error { return nil }
+
+// EvalToMatrix aggregates every step of the iterator and assembles the results into a matrix.
+// Series are keyed by their labels string: whatever the order of the series within each step,
+// the points of a series always land into the same matrix row.
+// The amount of distinct series emitted over the whole query is limited to maxSeries, zero
+// meaning unlimited, protecting the result assembly from series appearing and disappearing
+// over a long query. The iterator is consumed but not closed.
+func EvalToMatrix(it RangeVectorIterator, agg RangeVectorAggregator, maxSeries int) (promql.Matrix, error) {
+	b := newMatrixBuilder(maxSeries)
+	for nextLoaded(it) {
+		if err := b.add(it.At(agg)); err != nil {
+			return nil, err
+		}
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+	return b.matrix(), nil
+}
+
+const unitLabel = "__unit__"
+
+// EvalToMatrixWithUnit is like EvalToMatrix but stamps the unit of the aggregation, e.g
+// "per-second", onto every series as the `__unit__` label so that clients can pick the right
+// formatter. An empty unit is not stamped.
+func EvalToMatrixWithUnit(it RangeVectorIterator, agg RangeVectorAggregator, maxSeries int, unit string) (promql.Matrix, error) {
+	m, err := EvalToMatrix(it, agg, maxSeries)
+	if err != nil || unit == "" {
+		return m, err
+	}
+	for i := range m {
+		// the builder copies the labels, the metrics of the iterator are left untouched.
+		m[i].Metric = labels.NewBuilder(m[i].Metric).Set(unitLabel, unit).Labels()
+	}
+	return m, nil
+}
+
+// EvalToMatrixChunks is like EvalToMatrix but assembles the results into one matrix per chunk of
+// time, e.g per day, calling fn with each of them in order so that they can be returned page by
+// page without holding the whole result. Chunks are aligned on multiples of the chunk duration
+// since the Unix epoch, steps without any sample in a chunk produce no call.
+// The limit of series applies to the whole query. An error returned by fn stops the evaluation.
+// Chunks must be of at least one millisecond, the precision of steps.
+func EvalToMatrixChunks(it RangeVectorIterator, agg RangeVectorAggregator, maxSeries int, chunk time.Duration, fn func(promql.Matrix) error) error {
+	if chunk < time.Millisecond {
+		return fmt.Errorf("invalid chunk duration %s, must be at least 1ms", chunk)
+	}
+	var (
+		b       = newMatrixBuilder(maxSeries)
+		chunkMs = int64(chunk / time.Millisecond)
+		current int64
+		started bool
+	)
+	for nextLoaded(it) {
+		ts, vec := it.At(agg)
+		if id := ts / chunkMs; !started || id != current {
+			if started && len(b.result) > 0 {
+				if err := fn(b.matrix()); err != nil {
+					return err
+				}
+			}
+			// the series seen are kept to limit them over the whole query.
+			b.reset()
+			current, started = id, true
+		}
+		if err := b.add(ts, vec); err != nil {
+			return err
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	if len(b.result) > 0 {
+		return fn(b.matrix())
+	}
+	return nil
+}
+
+// matrixBuilder assembles vectors into a matrix, limiting the amount of distinct series.
+type matrixBuilder struct {
+	maxSeries int
+	result    promql.Matrix
+	// rows holds the row of the series in the result, or -1 for series from previous chunks.
+	rows map[string]int
+}
+
+func newMatrixBuilder(maxSeries int) *matrixBuilder {
+	return &matrixBuilder{
+		maxSeries: maxSeries,
+		rows:      map[string]int{},
+	}
+}
+
+func (b *matrixBuilder) add(ts int64, vec promql.Vector) error {
+	for _, p := range vec {
+		key := p.Metric.String()
+		row, ok := b.rows[key]
+		if !ok && b.maxSeries > 0 && len(b.rows) >= b.maxSeries {
+			return fmt.Errorf("maximum of series (%d) reached for a single query", b.maxSeries)
+		}
+		if !ok || row < 0 {
+			row = len(b.result)
+			b.rows[key] = row
+			b.result = append(b.result, promql.Series{
+				Metric: p.Metric,
+			})
+		}
+		b.result[row].Points = append(b.result[row].Points, promql.Point{
+			T: ts,
+			V: p.V,
+		})
+	}
+	return nil
+}
+
+// matrix returns the sorted matrix assembled so far.
+func (b *matrixBuilder) matrix() promql.Matrix {
+	sort.Sort(b.result)
+	return b.result
+}
+
+// reset starts a new matrix, still accounting for the series already seen in the limit.
+func (b *matrixBuilder) reset() {
+	for key := range b.rows {
+		b.rows[key] = -1
+	}
+	b.result = nil
+}
+
+// DefaultNoneBucket is the bucket of EvalToNestedMatrix for series without the outer label.
+const DefaultNoneBucket = "__none__"
+
+// EvalToNestedMatrix is like EvalToMatrix but nests the results by the value of the outer label,
+// e.g per datacenter, saving clients from grouping them again. Series without the outer label
+// are nested under the noneBucket key.
+func EvalToNestedMatrix(it RangeVectorIterator, agg RangeVectorAggregator, maxSeries int, outerLabel, noneBucket string) (map[string]promql.Matrix, error) {
+	m, err := EvalToMatrix(it, agg, maxSeries)
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]promql.Matrix{}
+	for _, series := range m {
+		bucket := noneBucket
+		if series.Metric.Has(outerLabel) {
+			bucket = series.Metric.Get(outerLabel)
+		}
+		// series stay sorted within each bucket.
+		result[bucket] = append(result[bucket], series)
+	}
+	return result, nil
+}
@@ -1,6 +1,8 @@
 package logql
 
 import (
+	"fmt"
+	"sort"
 	"testing"
 	"time"
 
@@ -113,3 +115,181 @@ func TestMatrixStepper(t *testing.T) {
 
 	require.Equal(t, ok, false)
 }
+
+func TestEvalToMatrix(t *testing.T) {
+	// a new series appears at every step, only two at a time are within the window.
+	newIterator := func() RangeVectorIterator {
+		return newRangeVectorIterator(newSliceSeriesIterator(
+			Sample{Labels: `{app="a"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 1},
+			Sample{Labels: `{app="b"}`, TimestampNano: time.Unix(2, 0).UnixNano(), Value: 2},
+			Sample{Labels: `{app="c"}`, TimestampNano: time.Unix(3, 0).UnixNano(), Value: 3},
+		), (2 * time.Second).Nanoseconds(), time.Second.Nanoseconds(), time.Unix(1, 0).UnixNano(), time.Unix(3, 0).UnixNano())
+	}
+
+	m, err := EvalToMatrix(newIterator(), sumOverTime, 3)
+	require.NoError(t, err)
+	require.Equal(t, promql.Matrix{
+		{Metric: labels.Labels{{Name: "app", Value: "a"}}, Points: []promql.Point{{T: 1000, V: 1}, {T: 2000, V: 1}}},
+		{Metric: labels.Labels{{Name: "app", Value: "b"}}, Points: []promql.Point{{T: 2000, V: 2}, {T: 3000, V: 2}}},
+		{Metric: labels.Labels{{Name: "app", Value: "c"}}, Points: []promql.Point{{T: 3000, V: 3}}},
+	}, m)
+
+	_, err = EvalToMatrix(newIterator(), sumOverTime, 2)
+	require.EqualError(t, err, "maximum of series (2) reached for a single query")
+}
+
+func TestEvalToNestedMatrix(t *testing.T) {
+	it := newRangeVectorIterator(newSliceSeriesIterator(
+		Sample{Labels: `{app="foo", dc="eu"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 1},
+		Sample{Labels: `{app="bar", dc="eu"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 2},
+		Sample{Labels: `{app="foo", dc="us"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 3},
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 4},
+	), time.Second.Nanoseconds(), time.Second.Nanoseconds(), time.Unix(1, 0).UnixNano(), time.Unix(1, 0).UnixNano())
+
+	m, err := EvalToNestedMatrix(it, sumOverTime, 0, "dc", DefaultNoneBucket)
+	require.NoError(t, err)
+	require.Equal(t, map[string]promql.Matrix{
+		"eu": {
+			{Metric: labels.Labels{{Name: "app", Value: "bar"}, {Name: "dc", Value: "eu"}}, Points: []promql.Point{{T: 1000, V: 2}}},
+			{Metric: labels.Labels{{Name: "app", Value: "foo"}, {Name: "dc", Value: "eu"}}, Points: []promql.Point{{T: 1000, V: 1}}},
+		},
+		"us": {
+			{Metric: labels.Labels{{Name: "app", Value: "foo"}, {Name: "dc", Value: "us"}}, Points: []promql.Point{{T: 1000, V: 3}}},
+		},
+		"__none__": {
+			{Metric: labels.Labels{{Name: "app", Value: "foo"}}, Points: []promql.Point{{T: 1000, V: 4}}},
+		},
+	}, m)
+}
+
+// vectorsIterator is a RangeVectorIterator returning predefined vectors, one per step.
+type vectorsIterator struct {
+	ts      []int64
+	vectors []promql.Vector
+	cur     int
+}
+
+func (v *vectorsIterator) Next() bool {
+	v.cur++
+	return v.cur <= len(v.vectors)
+}
+
+func (v *vectorsIterator) At(_ RangeVectorAggregator) (int64, promql.Vector) {
+	return v.ts[v.cur-1], v.vectors[v.cur-1]
+}
+
+func (v *vectorsIterator) Close() error { return nil }
+
+func (v *vectorsIterator) Error() error { return nil }
+
+func TestEvalToMatrixStableRows(t *testing.T) {
+	var (
+		a = labels.Labels{{Name: "app", Value: "a"}}
+		b = labels.Labels{{Name: "app", Value: "b"}}
+		c = labels.Labels{{Name: "app", Value: "c"}}
+	)
+	it := &vectorsIterator{
+		ts: []int64{1000, 2000, 3000},
+		vectors: []promql.Vector{
+			{{Metric: b, Point: promql.Point{V: 1}}, {Metric: a, Point: promql.Point{V: 2}}},
+			{{Metric: c, Point: promql.Point{V: 3}}, {Metric: a, Point: promql.Point{V: 4}}, {Metric: b, Point: promql.Point{V: 5}}},
+			{{Metric: a, Point: promql.Point{V: 6}}, {Metric: c, Point: promql.Point{V: 7}}},
+		},
+	}
+	m, err := EvalToMatrix(it, sumOverTime, 0)
+	require.NoError(t, err)
+	require.Equal(t, promql.Matrix{
+		{Metric: a, Points: []promql.Point{{T: 1000, V: 2}, {T: 2000, V: 4}, {T: 3000, V: 6}}},
+		{Metric: b, Points: []promql.Point{{T: 1000, V: 1}, {T: 2000, V: 5}}},
+		{Metric: c, Points: []promql.Point{{T: 2000, V: 3}, {T: 3000, V: 7}}},
+	}, m)
+}
+
+func TestEvalToMatrixChunks(t *testing.T) {
+	newIt := func() RangeVectorIterator {
+		return newRangeVectorIterator(newfakeSeriesIterator(),
+			(5 * time.Second).Nanoseconds(), (5 * time.Second).Nanoseconds(),
+			time.Unix(10, 0).UnixNano(), time.Unix(100, 0).UnixNano())
+	}
+	full, err := EvalToMatrix(newIt(), countOverTime, 0)
+	require.NoError(t, err)
+	require.NotEmpty(t, full)
+
+	var chunks []promql.Matrix
+	err = EvalToMatrixChunks(newIt(), countOverTime, 0, 20*time.Second, func(m promql.Matrix) error {
+		chunks = append(chunks, m)
+		return nil
+	})
+	require.NoError(t, err)
+	// samples from 10s to 100s land in 4 chunks of 20s, the others being empty.
+	require.Len(t, chunks, 4)
+
+	var (
+		concatenated promql.Matrix
+		rows         = map[string]int{}
+	)
+	for _, chunk := range chunks {
+		for _, series := range chunk {
+			// every point of a chunk belongs to the same 20s.
+			for _, p := range series.Points {
+				require.Equal(t, chunk[0].Points[0].T/20000, p.T/20000)
+			}
+			row, ok := rows[series.Metric.String()]
+			if !ok {
+				row = len(concatenated)
+				rows[series.Metric.String()] = row
+				concatenated = append(concatenated, promql.Series{Metric: series.Metric})
+			}
+			concatenated[row].Points = append(concatenated[row].Points, series.Points...)
+		}
+	}
+	sort.Sort(concatenated)
+	require.Equal(t, full, concatenated)
+
+	// the limit of series applies to the whole query.
+	err = EvalToMatrixChunks(newIt(), countOverTime, 1, 20*time.Second, func(promql.Matrix) error { return nil })
+	require.EqualError(t, err, "maximum of series (1) reached for a single query")
+
+	for _, chunk := range []time.Duration{0, time.Microsecond, -time.Second} {
+		err = EvalToMatrixChunks(newIt(), countOverTime, 0, chunk, func(promql.Matrix) error { return nil })
+		require.EqualError(t, err, fmt.Sprintf("invalid chunk duration %s, must be at least 1ms", chunk))
+	}
+}
+
+func TestEvalToMatrixWithUnit(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		unit  string
+	}{
+		{`rate({app="foo"}[1m])`, UnitPerSecond},
+		{`bytes_over_time({app="foo"}[1m])`, UnitBytes},
+		{`bytes_rate({app="foo"}[1m])`, UnitBytesPerSecond},
+		{`count_over_time({app="foo"}[1m])`, UnitCount},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			expr, err := ParseExpr(tc.query)
+			require.NoError(t, err)
+			_, unit, err := expr.(*rangeAggregationExpr).aggregator()
+			require.NoError(t, err)
+			require.Equal(t, tc.unit, unit)
+		})
+	}
+
+	expr, err := ParseExpr(`rate({app="foo"}[1s])`)
+	require.NoError(t, err)
+	agg, unit, err := expr.(*rangeAggregationExpr).aggregator()
+	require.NoError(t, err)
+	m, err := EvalToMatrixWithUnit(newDropOutIterator(), agg, 0, unit)
+	require.NoError(t, err)
+	require.Len(t, m, 2)
+	for _, series := range m {
+		require.Equal(t, "per-second", series.Metric.Get("__unit__"))
+	}
+
+	// an empty unit is not stamped.
+	m, err = EvalToMatrixWithUnit(newDropOutIterator(), agg, 0, "")
+	require.NoError(t, err)
+	for _, series := range m {
+		require.False(t, series.Metric.Has("__unit__"))
+	}
+}
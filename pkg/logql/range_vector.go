@@ -1,7 +1,13 @@
 package logql
 
 import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/promql"
@@ -22,50 +28,621 @@ type RangeVectorIterator interface {
 	Error() error
 }
 
+// pendingIterator is a range vector iterator whose steps can be pending, see
+// rangeVectorIterator.Pending.
+type pendingIterator interface {
+	Pending() bool
+}
+
+// nextLoaded moves the iterator to the next step whose window is loaded, skipping the steps
+// pending the resume of their load, see withStepTimeout. Consumers of range vector iterators
+// must use it instead of Next.
+func nextLoaded(it RangeVectorIterator) bool {
+	for it.Next() {
+		if p, ok := it.(pendingIterator); !ok || !p.Pending() {
+			return true
+		}
+	}
+	return false
+}
+
 type rangeVectorIterator struct {
 	iter                         SeriesIterator
 	selRange, step, end, current int64
 	window                       map[string]*promql.Series
 	metrics                      map[string]labels.Labels
+
+	// pointsGrowth is the fraction by which a series points capacity grows when full.
+	// When zero the append growth is used.
+	pointsGrowth float64
+	// totals accumulates per series the values of all steps aggregated by totalsAgg, when not nil.
+	totals    map[string]*promql.Sample
+	totalsAgg RangeVectorAggregator
+	// retentionStart is the nanoseconds timestamp of the oldest retained data, zero if unknown.
+	retentionStart int64
+	warnings       []string
+	// stepTimeout bounds the time spent loading a window, zero means unbounded.
+	stepTimeout                time.Duration
+	deadline                   time.Time
+	timedOut, pending, partial bool
+	// earliest is the start of the first window, samples before are out of the query range.
+	earliest      int64
+	rejectedEarly int
+	consumers     []WindowConsumer
+	// minCoverage is the minimum fraction of the range a series samples must span to be emitted.
+	minCoverage float64
+	// tracer creates a span per step, ended by the following Next or Close call.
+	tracer Tracer
+	span   Span
+	loaded int
+	// maxMagnitude is the maximum absolute value of samples, zero means unlimited.
+	maxMagnitude    float64
+	magnitudePolicy magnitudePolicy
+	outOfMagnitude  int
+	// windowSizes counts steps per bucket index of window points count, see windowSizeBucket.
+	windowSizes  []int
+	windowPoints int
+	// progress reports partial aggregations of the window being loaded every progressInterval.
+	progress         func(ts int64, partial promql.Vector)
+	progressAgg      IncrementalAggregator
+	progressInterval time.Duration
+	lastProgress     time.Time
+	// maxWindowSize is the rolling maximum amount of series of the windows, buffers of AtInto are
+	// pre-sized to twice that.
+	maxWindowSize int
+	// todBucket returns the time of day bucket of a milliseconds step timestamp.
+	todBucket func(ts int64) string
+	// rounding is the power of ten to round output values to, zero means no rounding.
+	rounding float64
+	// locks bounds the amount of iterators holding windows concurrently, a lock is taken
+	// before the first load until Close.
+	ctx    context.Context
+	locks  chan struct{}
+	locked bool
+	err    error
+	// bucketSize is the nanoseconds duration of the buckets pre-aggregating samples, zero means none.
+	bucketSize int64
+	// bucketCounts holds per series the amount of samples of each bucketed point.
+	bucketCounts map[string][]int
+	expanded     []promql.Point
+	// invalid is the reason the query range is invalid, empty when valid.
+	invalid string
+	// maxLabelNames is the maximum amount of label names of a series, zero means unlimited.
+	maxLabelNames  int
+	rejectedSeries map[string]struct{}
+	// minStep is the minimum step, finer steps are coarsened to it.
+	minStep, requestedStep int64
+	outputTsOffset         int64
+}
+
+// IncrementalAggregator is an aggregator whose result over a partially loaded window is a
+// meaningful partial result. It is only implemented by IncrementalSum and IncrementalCount.
+type IncrementalAggregator interface {
+	// aggregator is unexported so that no other aggregator can be incremental.
+	aggregator() RangeVectorAggregator
+}
+
+type incrementalAggregator RangeVectorAggregator
+
+func (a incrementalAggregator) aggregator() RangeVectorAggregator {
+	return RangeVectorAggregator(a)
+}
+
+var (
+	// IncrementalSum sums the values of the samples loaded so far.
+	IncrementalSum IncrementalAggregator = incrementalAggregator(sumOverTime)
+	// IncrementalCount counts the samples loaded so far.
+	IncrementalCount IncrementalAggregator = incrementalAggregator(countOverTime)
+)
+
+// magnitudePolicy defines how samples exceeding the maximum magnitude are handled.
+type magnitudePolicy int
+
+const (
+	// magnitudeReject drops the sample.
+	magnitudeReject magnitudePolicy = iota
+	// magnitudeClamp replaces the sample value by the maximum magnitude of the same sign.
+	magnitudeClamp
+)
+
+// Tracer creates spans. It is a minimal interface any tracing library can be adapted to.
+type Tracer interface {
+	StartSpan(name string) Span
+}
+
+// Span is a traced operation.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	End()
+}
+
+// WindowSnapshot is a read-only view of the current window of a range vector iterator.
+// It is only valid until the next call to Next, points must not be retained nor mutated.
+type WindowSnapshot struct {
+	ts int64
+	it *rangeVectorIterator
+}
+
+// Timestamp returns the milliseconds timestamp of the window end, shifted by the output offset.
+func (s WindowSnapshot) Timestamp() int64 {
+	return s.ts
+}
+
+// Aggregate returns the vector of the window aggregated by the given aggregator.
+func (s WindowSnapshot) Aggregate(aggregator RangeVectorAggregator) promql.Vector {
+	result := make([]promql.Sample, 0, len(s.it.window))
+	for lbs, series := range s.it.window {
+		result = append(result, promql.Sample{
+			Point: promql.Point{
+				V: aggregator(s.it.points(lbs, series)),
+				T: s.ts,
+			},
+			Metric: series.Metric,
+		})
+	}
+	return result
+}
+
+// WindowConsumer consumes the snapshot of each window loaded by a range vector iterator.
+type WindowConsumer func(WindowSnapshot)
+
+// rangeVectorIteratorOption configures optional behaviours of the rangeVectorIterator.
+type rangeVectorIteratorOption func(*rangeVectorIterator)
+
+// withPointsGrowth grows series points capacity by the given fraction (e.g 0.1) instead of the
+// append growth. Append doubles small slices but grows large ones by about 1.25, so only fractions
+// below 0.25 lower the transient peak of large windows, when both the old and the new arrays are
+// alive, and only slightly, see BenchmarkRangeVectorIteratorPointsGrowth. Lower fractions
+// reallocate and copy more often.
+func withPointsGrowth(fraction float64) rangeVectorIteratorOption {
+	return func(r *rangeVectorIterator) {
+		r.pointsGrowth = fraction
+	}
+}
+
+// withTotals accumulates per series the values of all steps aggregated by the aggregator, once
+// per step whatever the calls to At, see Finalize.
+func withTotals(aggregator RangeVectorAggregator) rangeVectorIteratorOption {
+	return func(r *rangeVectorIterator) {
+		r.totals = map[string]*promql.Sample{}
+		r.totalsAgg = aggregator
+	}
+}
+
+// withRetentionStart warns, see Warnings, when the first window reaches before the data retention.
+func withRetentionStart(retentionStart int64) rangeVectorIteratorOption {
+	return func(r *rangeVectorIterator) {
+		r.retentionStart = retentionStart
+	}
+}
+
+// withStepTimeout bounds the time spent loading each window. A window that times out is left
+// pending, see Pending, and its load is resumed once by the following Next call, from where it
+// stopped, before being emitted as partial if it times out again, see Partial.
+// The deadline is checked between samples, a single blocking read of the source is not bounded.
+func withStepTimeout(timeout time.Duration) rangeVectorIteratorOption {
+	return func(r *rangeVectorIterator) {
+		r.stepTimeout = timeout
+	}
+}
+
+// withMinCoverage omits from the result the series whose samples, from first to last, span less
+// than the given fraction of the range. This suppresses sparse and partial windows.
+func withMinCoverage(fraction float64) rangeVectorIteratorOption {
+	return func(r *rangeVectorIterator) {
+		r.minCoverage = fraction
+	}
+}
+
+// withTracer traces each step from its load until the following step, recording the amount of
+// samples loaded, the window series count and the load duration.
+func withTracer(tracer Tracer) rangeVectorIteratorOption {
+	return func(r *rangeVectorIterator) {
+		r.tracer = tracer
+	}
+}
+
+// withMaxMagnitude guards against corrupted values by rejecting or clamping, as defined by the policy,
+// samples whose absolute value exceeds the maximum magnitude. See OutOfMagnitudeSamples.
+func withMaxMagnitude(maxMagnitude float64, policy magnitudePolicy) rangeVectorIteratorOption {
+	return func(r *rangeVectorIterator) {
+		r.maxMagnitude = maxMagnitude
+		r.magnitudePolicy = policy
+	}
+}
+
+// withProgress calls the progress callback every interval while loading a window, with the
+// partial aggregation of the samples loaded so far. This reports progress during long loads.
+func withProgress(interval time.Duration, agg IncrementalAggregator, progress func(ts int64, partial promql.Vector)) rangeVectorIteratorOption {
+	return func(r *rangeVectorIterator) {
+		r.progressInterval = interval
+		r.progressAgg = agg
+		r.progress = progress
+	}
+}
+
+// todBucketLabel is the label added to results to tag them with their time of day bucket.
+const todBucketLabel = "__tod_bucket__"
+
+// withTimeOfDayBucket tags each result sample with the time of day bucket of its step. The bucket
+// function receives the milliseconds step timestamp, e.g to return the hour of the day.
+func withTimeOfDayBucket(bucket func(ts int64) string) rangeVectorIteratorOption {
+	return func(r *rangeVectorIterator) {
+		r.todBucket = bucket
+	}
+}
+
+// withRounding rounds the output values to the given number of decimal places. Rounding happens
+// after aggregation for display purposes, window points are left untouched.
+func withRounding(decimals int) rangeVectorIteratorOption {
+	return func(r *rangeVectorIterator) {
+		r.rounding = math.Pow10(decimals)
+	}
+}
+
+// withOutputTsOffset shifts every output timestamp by the offset in nanoseconds: At and its
+// variants, snapshots, consumers, progress, totals and TimestampNano. This aligns the output with
+// another data source. Unlike the offset modifier, the aggregated windows are left untouched, as
+// are the time of day buckets which are those of the actual steps.
+func withOutputTsOffset(offset int64) rangeVectorIteratorOption {
+	return func(r *rangeVectorIterator) {
+		r.outputTsOffset = offset
+	}
+}
+
+// newIteratorLocks returns locks to share between iterators created withLocks, allowing at
+// most size of them to hold a window concurrently.
+func newIteratorLocks(size int) chan struct{} {
+	locks := make(chan struct{}, size)
+	for i := 0; i < size; i++ {
+		locks <- struct{}{}
+	}
+	return locks
+}
+
+// withLocks takes one of the locks before loading the first window and releases it on Close.
+// Waiting for a lock is canceled with the context.
+func withLocks(ctx context.Context, locks chan struct{}) rangeVectorIteratorOption {
+	return func(r *rangeVectorIterator) {
+		r.ctx = ctx
+		r.locks = locks
+	}
+}
+
+// withPreAggregation sums, as they are loaded, the samples of each series falling in the same
+// bucket of the given nanoseconds duration into a single point, timestamped with the first sample,
+// along with their count. This caps the series storage at selRange/bucketSize points regardless
+// of the ingestion rate.
+// Every reader of the window (At and its variants, snapshots and progress) receives each bucket
+// as its count of points valued at the bucket mean, so that counts, sums, rates and averages are
+// kept while extrema, deviations and predicates apply to the bucket means. The points are
+// expanded one series at a time into a buffer reused across series and steps, only the storage
+// is capped. A bucket leaves the window with its first sample: results are accurate only up to
+// the samples of the bucket straddling the window start.
+func withPreAggregation(bucketSize int64) rangeVectorIteratorOption {
+	return func(r *rangeVectorIterator) {
+		r.bucketSize = bucketSize
+		r.bucketCounts = map[string][]int{}
+	}
+}
+
+// withMaxLabelNames rejects the series with more label names than the maximum, which is most likely
+// a labeling mistake inflating memory and results. See RejectedSeries.
+func withMaxLabelNames(maxLabelNames int) rangeVectorIteratorOption {
+	return func(r *rangeVectorIterator) {
+		r.maxLabelNames = maxLabelNames
+	}
+}
+
+// withMinStep coarsens steps finer than the minimum step up to it, protecting backends from
+// abusively fine queries. Negative steps are invalid and left as is, see StepAdjusted and Valid.
+func withMinStep(minStep int64) rangeVectorIteratorOption {
+	return func(r *rangeVectorIterator) {
+		r.minStep = minStep
+	}
 }
 
 func newRangeVectorIterator(
 	it SeriesIterator,
-	selRange, step, start, end int64) *rangeVectorIterator {
+	selRange, step, start, end int64, opts ...rangeVectorIteratorOption) *rangeVectorIterator {
 	// forces at least one step.
 	if step == 0 {
 		step = 1
 	}
-	return &rangeVectorIterator{
-		iter:     it,
-		step:     step,
-		end:      end,
-		selRange: selRange,
-		current:  start - step, // first loop iteration will set it to start
-		window:   map[string]*promql.Series{},
-		metrics:  map[string]labels.Labels{},
+	r := &rangeVectorIterator{
+		iter:           it,
+		step:           step,
+		end:            end,
+		selRange:       selRange,
+		current:        start - step, // first loop iteration will set it to start
+		earliest:       start - selRange,
+		window:         map[string]*promql.Series{},
+		metrics:        map[string]labels.Labels{},
+		rejectedSeries: map[string]struct{}{},
+	}
+	switch {
+	case start > end:
+		r.invalid = "the start of the query range is after its end"
+	case step < 0:
+		r.invalid = "the query step is negative"
+	case selRange < 0:
+		r.invalid = "the range of the query is negative"
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	// invalid steps are not coarsened, the query stays invalid.
+	if r.invalid == "" && r.minStep > 0 && r.step < r.minStep {
+		r.requestedStep = r.step
+		r.step = r.minStep
+		r.current = start - r.step // first loop iteration will set it to start
+	}
+	if r.retentionStart != 0 && start-selRange < r.retentionStart {
+		r.warnings = append(r.warnings, fmt.Sprintf(
+			"the first window starts at %s before the retention start %s, leading results may be sparse",
+			time.Unix(0, start-selRange).UTC().Format(time.RFC3339Nano),
+			time.Unix(0, r.retentionStart).UTC().Format(time.RFC3339Nano),
+		))
 	}
+	return r
+}
+
+// newRangeVectorIteratorWithSeed returns a range vector iterator starting with the seed window
+// already loaded, e.g the tail of a previous evaluation of a continuous query, keyed by series
+// labels string with points in nanoseconds. The iterator only has to yield the samples after the
+// seed. Seed points are copied, the seed window is left untouched.
+func newRangeVectorIteratorWithSeed(
+	it SeriesIterator, seedWindow map[string]*promql.Series,
+	selRange, step, start, end int64, opts ...rangeVectorIteratorOption) *rangeVectorIterator {
+	r := newRangeVectorIterator(it, selRange, step, start, end, opts...)
+	for lbs, seed := range seedWindow {
+		if len(seed.Points) == 0 {
+			continue
+		}
+		series := getSeries()
+		series.Metric = seed.Metric
+		series.Points = append(series.Points, seed.Points...)
+		r.windowPoints += len(series.Points)
+		r.window[lbs] = series
+		r.metrics[lbs] = seed.Metric
+		if r.bucketSize > 0 {
+			// seed points are taken as single samples.
+			counts := make([]int, len(series.Points))
+			for i := range counts {
+				counts[i] = 1
+			}
+			r.bucketCounts[lbs] = counts
+		}
+	}
+	return r
+}
+
+// StepAdjusted tells if the requested step was coarsened to the minimum step, returning both
+// the requested and the effective steps.
+func (r *rangeVectorIterator) StepAdjusted() (adjusted bool, requested, effective int64) {
+	if r.requestedStep == 0 {
+		return false, r.step, r.step
+	}
+	return true, r.requestedStep, r.step
+}
+
+// Valid tells if the query range is valid. An invalid query has no steps, unlike a valid query
+// without any data, see Reason.
+func (r *rangeVectorIterator) Valid() bool {
+	return r.invalid == ""
+}
+
+// Reason returns why the query range is invalid, empty when valid.
+func (r *rangeVectorIterator) Reason() string {
+	return r.invalid
+}
+
+// TimestampNano returns the nanoseconds timestamp of the current step, as reported by At.
+func (r *rangeVectorIterator) TimestampNano() int64 {
+	return r.current + r.outputTsOffset
+}
+
+// Warnings returns the warnings about the query detected by the iterator.
+func (r *rangeVectorIterator) Warnings() []string {
+	return r.warnings
 }
 
 func (r *rangeVectorIterator) Next() bool {
+	r.endSpan()
+	if r.tracer == nil {
+		return r.next()
+	}
+	span := r.tracer.StartSpan("rangeVectorIterator.Next")
+	start := time.Now()
+	r.loaded = 0
+	if !r.next() {
+		span.End()
+		return false
+	}
+	span.SetAttribute("step", r.current/1e+6)
+	span.SetAttribute("samples", r.loaded)
+	span.SetAttribute("series", len(r.window))
+	span.SetAttribute("load_duration", time.Since(start))
+	r.span = span
+	return true
+}
+
+func (r *rangeVectorIterator) endSpan() {
+	if r.span != nil {
+		r.span.End()
+		r.span = nil
+	}
+}
+
+func (r *rangeVectorIterator) next() bool {
+	if r.invalid != "" {
+		return false
+	}
+	if r.pending {
+		// resumes loading the current window from where it timed out, for the same step.
+		r.pending = false
+		r.loadWithTimeout(r.current-r.selRange, r.current)
+		r.partial = r.timedOut
+		r.windowLoaded()
+		return true
+	}
 	// slides the range window to the next position
 	r.current = r.current + r.step
 	if r.current > r.end {
 		return false
 	}
+	if !r.acquire() {
+		return false
+	}
 	rangeEnd := r.current
 	rangeStart := r.current - r.selRange
 	// load samples
 	r.popBack(rangeStart)
-	r.load(rangeStart, rangeEnd)
+	r.loadWithTimeout(rangeStart, rangeEnd)
+	r.partial = false
+	if r.timedOut {
+		// the window is completed by the following call.
+		r.pending = true
+		return true
+	}
+	r.windowLoaded()
 	return true
 }
 
+// WindowSizeHistogram returns the amount of steps per bucket of window points count.
+// Buckets are "0", "1-10", "11-100" and so on by power of ten.
+func (r *rangeVectorIterator) WindowSizeHistogram() map[string]int {
+	histogram := make(map[string]int, len(r.windowSizes))
+	lower, upper := 1, 10
+	for i, count := range r.windowSizes {
+		if i > 1 {
+			lower, upper = upper+1, upper*10
+		}
+		if count == 0 {
+			continue
+		}
+		if i == 0 {
+			histogram["0"] = count
+			continue
+		}
+		histogram[fmt.Sprintf("%d-%d", lower, upper)] = count
+	}
+	return histogram
+}
+
+// windowSizeBucket returns the index of the bucket of a window points count: 0 for empty
+// windows, 1 up to 10 points, 2 up to 100 points and so on.
+func windowSizeBucket(size int) int {
+	if size == 0 {
+		return 0
+	}
+	bucket, upper := 1, 10
+	for size > upper {
+		bucket, upper = bucket+1, upper*10
+	}
+	return bucket
+}
+
+// Register adds a consumer called with the snapshot of every window once loaded.
+// This allows many aggregations over the same windows without loading them more than once.
+func (r *rangeVectorIterator) Register(consumer WindowConsumer) {
+	r.consumers = append(r.consumers, consumer)
+}
+
+// Snapshot returns a read-only view of the current window valid until the next call to Next.
+func (r *rangeVectorIterator) Snapshot() WindowSnapshot {
+	return WindowSnapshot{
+		ts: r.outputTs(),
+		it: r,
+	}
+}
+
+// windowLoaded is called once the current window is completely loaded.
+func (r *rangeVectorIterator) windowLoaded() {
+	if r.totals != nil {
+		r.accumulate()
+	}
+	bucket := windowSizeBucket(r.windowPoints)
+	for len(r.windowSizes) <= bucket {
+		r.windowSizes = append(r.windowSizes, 0)
+	}
+	r.windowSizes[bucket]++
+
+	if len(r.consumers) == 0 {
+		return
+	}
+	snapshot := r.Snapshot()
+	for _, consumer := range r.consumers {
+		consumer(snapshot)
+	}
+}
+
+func (r *rangeVectorIterator) loadWithTimeout(start, end int64) {
+	r.timedOut = false
+	if r.stepTimeout > 0 {
+		r.deadline = time.Now().Add(r.stepTimeout)
+	}
+	if r.progress != nil {
+		r.lastProgress = time.Now()
+	}
+	r.load(start, end)
+}
+
+// RejectedEarlySamples returns the amount of samples rejected for being before the first window.
+func (r *rangeVectorIterator) RejectedEarlySamples() int {
+	return r.rejectedEarly
+}
+
+// OutOfMagnitudeSamples returns the amount of samples rejected or clamped for exceeding the maximum magnitude.
+func (r *rangeVectorIterator) OutOfMagnitudeSamples() int {
+	return r.outOfMagnitude
+}
+
+// RejectedSeries returns the amount of series rejected for having too many label names.
+func (r *rangeVectorIterator) RejectedSeries() int {
+	return len(r.rejectedSeries)
+}
+
+// Pending tells if the load of the current window timed out and is resumed by the following
+// Next call for the same step. A pending window is incomplete and is not emitted to consumers
+// nor accumulated to totals, pending steps are skipped by nextLoaded.
+func (r *rangeVectorIterator) Pending() bool {
+	return r.pending
+}
+
+// Partial tells if the current window timed out again after being resumed and is incomplete.
+func (r *rangeVectorIterator) Partial() bool {
+	return r.partial
+}
+
+// acquire takes a lock before the first load when the iterator is created withLocks.
+func (r *rangeVectorIterator) acquire() bool {
+	if r.locks == nil || r.locked {
+		return true
+	}
+	select {
+	case <-r.locks:
+		r.locked = true
+		return true
+	case <-r.ctx.Done():
+		r.err = r.ctx.Err()
+		return false
+	}
+}
+
 func (r *rangeVectorIterator) Close() error {
+	r.endSpan()
+	if r.locked {
+		r.locked = false
+		r.locks <- struct{}{}
+	}
 	return r.iter.Close()
 }
 
 func (r *rangeVectorIterator) Error() error {
+	if r.err != nil {
+		return r.err
+	}
 	return r.iter.Error()
 }
 
@@ -84,11 +661,16 @@ func (r *rangeVectorIterator) popBack(newStart int64) {
 			break
 		}
 		if remove {
+			r.windowPoints -= lastPoint + 1
 			r.window[fp].Points = r.window[fp].Points[lastPoint+1:]
+			if r.bucketSize > 0 {
+				r.bucketCounts[fp] = r.bucketCounts[fp][lastPoint+1:]
+			}
 		}
 		if len(r.window[fp].Points) == 0 {
 			s := r.window[fp]
 			delete(r.window, fp)
+			delete(r.bucketCounts, fp)
 			putSeries(s)
 		}
 	}
@@ -96,21 +678,50 @@ func (r *rangeVectorIterator) popBack(newStart int64) {
 
 // load the next sample range window.
 func (r *rangeVectorIterator) load(start, end int64) {
-	for sample, hasNext := r.iter.Peek(); hasNext; sample, hasNext = r.iter.Peek() {
+	for {
+		// checked before every read, whether the previous sample was kept or not.
+		if r.stepTimeout > 0 && time.Now().After(r.deadline) {
+			r.timedOut = true
+			return
+		}
+		sample, hasNext := r.iter.Peek()
+		if !hasNext {
+			return
+		}
 		if sample.TimestampNano > end {
 			// not consuming the iterator as this belong to another range.
 			return
 		}
+		// samples before the first window are out of the query range and are a source bug. The
+		// store is queried from the first window start included, samples at that exact time are
+		// dropped below by the exclusive lower bound of the range.
+		if sample.TimestampNano < r.earliest {
+			r.rejectedEarly++
+			_ = r.iter.Next()
+			continue
+		}
 		// the lower bound of the range is not inclusive
 		if sample.TimestampNano <= start {
 			_ = r.iter.Next()
 			continue
 		}
+		if r.maxMagnitude > 0 && math.Abs(sample.Value) > r.maxMagnitude {
+			r.outOfMagnitude++
+			if r.magnitudePolicy == magnitudeReject {
+				_ = r.iter.Next()
+				continue
+			}
+			sample.Value = math.Copysign(r.maxMagnitude, sample.Value)
+		}
 		// adds the sample.
 		var series *promql.Series
 		var ok bool
 		series, ok = r.window[sample.Labels]
 		if !ok {
+			if _, ok = r.rejectedSeries[sample.Labels]; ok {
+				_ = r.iter.Next()
+				continue
+			}
 			var metric labels.Labels
 			if metric, ok = r.metrics[sample.Labels]; !ok {
 				var err error
@@ -118,6 +729,11 @@ func (r *rangeVectorIterator) load(start, end int64) {
 				if err != nil {
 					continue
 				}
+				if r.maxLabelNames > 0 && len(metric) > r.maxLabelNames {
+					r.rejectedSeries[sample.Labels] = struct{}{}
+					_ = r.iter.Next()
+					continue
+				}
 				r.metrics[sample.Labels] = metric
 			}
 
@@ -129,27 +745,596 @@ func (r *rangeVectorIterator) load(start, end int64) {
 			T: sample.TimestampNano,
 			V: sample.Value,
 		}
-		series.Points = append(series.Points, p)
+		if n := len(series.Points); r.bucketSize > 0 && n > 0 && r.bucket(series.Points[n-1].T) == r.bucket(p.T) {
+			series.Points[n-1].V += p.V
+			r.bucketCounts[sample.Labels][n-1]++
+		} else {
+			r.appendPoint(series, p)
+			if r.bucketSize > 0 {
+				r.bucketCounts[sample.Labels] = append(r.bucketCounts[sample.Labels], 1)
+			}
+		}
+		r.loaded++
 		_ = r.iter.Next()
+		if r.progress != nil && time.Since(r.lastProgress) >= r.progressInterval {
+			r.lastProgress = time.Now()
+			r.progress(r.outputTs(), r.Snapshot().Aggregate(r.progressAgg.aggregator()))
+		}
+	}
+}
+
+// bucket returns the pre-aggregation bucket of a nanoseconds timestamp.
+func (r *rangeVectorIterator) bucket(ts int64) int64 {
+	b := ts / r.bucketSize
+	if ts < 0 && ts%r.bucketSize != 0 {
+		b--
 	}
+	return b
+}
+
+// appendPoint adds a point to the series, growing its capacity as configured.
+func (r *rangeVectorIterator) appendPoint(series *promql.Series, p promql.Point) {
+	r.windowPoints++
+	if r.pointsGrowth <= 0 || len(series.Points) < cap(series.Points) {
+		series.Points = append(series.Points, p)
+		return
+	}
+	grow := int(float64(cap(series.Points)) * r.pointsGrowth)
+	if grow < 1 {
+		grow = 1
+	}
+	points := make([]promql.Point, len(series.Points), cap(series.Points)+grow)
+	copy(points, series.Points)
+	series.Points = append(points, p)
 }
 
 func (r *rangeVectorIterator) At(aggregator RangeVectorAggregator) (int64, promql.Vector) {
-	result := make([]promql.Sample, 0, len(r.window))
+	return r.at(aggregator, make([]promql.Sample, 0, len(r.window)))
+}
+
+// AtInto is like At but writes the result into buf, reusing its memory across steps.
+// When too small for the window, the buffer is re-allocated once with twice the capacity of
+// the largest window seen so far, leaving room for spikier later steps, instead of growing
+// with every append.
+func (r *rangeVectorIterator) AtInto(aggregator RangeVectorAggregator, buf promql.Vector) (int64, promql.Vector) {
+	if len(r.window) > r.maxWindowSize {
+		r.maxWindowSize = len(r.window)
+	}
+	if cap(buf) < r.maxWindowSize {
+		buf = make(promql.Vector, 0, 2*r.maxWindowSize)
+	}
+	return r.at(aggregator, buf[:0])
+}
+
+func (r *rangeVectorIterator) at(aggregator RangeVectorAggregator, result promql.Vector) (int64, promql.Vector) {
+	r.eachSeries(func(_ string, metric labels.Labels, points []promql.Point) {
+		result = append(result, r.output(metric, aggregator(points)))
+	})
+	return r.outputTs(), result
+}
+
+// eachSeries calls fn with the labels string, the metric and the points, see points, of every
+// series of the window covering enough of the range, see withMinCoverage. This is the path shared
+// by At and its variants, the points are only valid for the duration of the call.
+func (r *rangeVectorIterator) eachSeries(fn func(lbs string, metric labels.Labels, points []promql.Point)) {
+	for lbs, series := range r.window {
+		if r.minCoverage > 0 && !r.covers(series.Points) {
+			continue
+		}
+		fn(lbs, series.Metric, r.points(lbs, series))
+	}
+}
+
+// output returns the sample of the current step for a value computed from the window, rounded
+// and tagged with the time of day bucket as configured.
+func (r *rangeVectorIterator) output(metric labels.Labels, v float64) promql.Sample {
+	if r.rounding != 0 {
+		v = r.round(v)
+	}
+	if r.todBucket != nil {
+		// the builder copies the labels, the cached series metric is left untouched.
+		// convert ts from nano to milli seconds as the iterator work with nanoseconds
+		metric = labels.NewBuilder(metric).Set(todBucketLabel, r.todBucket(r.current/1e+6)).Labels()
+	}
+	return promql.Sample{
+		Point:  promql.Point{T: r.outputTs(), V: v},
+		Metric: metric,
+	}
+}
+
+// outputTs returns the milliseconds timestamp of the current step, shifted by the output offset.
+func (r *rangeVectorIterator) outputTs() int64 {
 	// convert ts from nano to milli seconds as the iterator work with nanoseconds
-	ts := r.current / 1e+6
-	for _, series := range r.window {
-		result = append(result, promql.Sample{
-			Point: promql.Point{
-				V: aggregator(series.Points),
-				T: ts,
+	return (r.current + r.outputTsOffset) / 1e+6
+}
+
+// points returns the points of a series as seen by every reader of the window, with bucketed
+// points expanded to their count of points valued at the bucket mean, see withPreAggregation.
+// The expanded points are only valid until the next call.
+func (r *rangeVectorIterator) points(lbs string, series *promql.Series) []promql.Point {
+	if r.bucketSize == 0 {
+		return series.Points
+	}
+	counts := r.bucketCounts[lbs]
+	r.expanded = r.expanded[:0]
+	for i, p := range series.Points {
+		mean := promql.Point{T: p.T, V: p.V / float64(counts[i])}
+		for j := 0; j < counts[i]; j++ {
+			r.expanded = append(r.expanded, mean)
+		}
+	}
+	return r.expanded
+}
+
+func (r *rangeVectorIterator) round(v float64) float64 {
+	// values beyond 2^52 have no fractional part, scaling them could overflow.
+	if math.IsNaN(v) || math.IsInf(v, 0) || math.Abs(v) >= 1<<52 {
+		return v
+	}
+	scaled := v * r.rounding
+	if math.IsInf(scaled, 0) {
+		return v
+	}
+	return math.Round(scaled) / r.rounding
+}
+
+// AtDistinctRate returns, per group of the by labels, the amount of distinct values of the target
+// label within the window divided by the range in seconds, e.g the rate of new unique users.
+// Series without the target label are ignored. A zero range results in NaN. Series are filtered,
+// and groups rounded and tagged, as by At.
+func (r *rangeVectorIterator) AtDistinctRate(target string, by []string) (int64, promql.Vector) {
+	type group struct {
+		metric labels.Labels
+		values map[string]struct{}
+	}
+	var (
+		groups = map[uint64]*group{}
+		buf    []byte
+		hash   uint64
+	)
+	// label names must be sorted to hash and select labels, the caller slice is left untouched.
+	by = append([]string(nil), by...)
+	sort.Strings(by)
+	r.eachSeries(func(_ string, metric labels.Labels, _ []promql.Point) {
+		if !metric.Has(target) {
+			return
+		}
+		hash, buf = metric.HashForLabels(buf, by...)
+		g, ok := groups[hash]
+		if !ok {
+			g = &group{
+				metric: metric.WithLabels(by...),
+				values: map[string]struct{}{},
+			}
+			groups[hash] = g
+		}
+		g.values[metric.Get(target)] = struct{}{}
+	})
+	result := make(promql.Vector, 0, len(groups))
+	for _, g := range groups {
+		v := math.NaN()
+		// guard against divide by zero
+		if r.selRange != 0 {
+			v = float64(len(g.values)) / time.Duration(r.selRange).Seconds()
+		}
+		result = append(result, r.output(g.metric, v))
+	}
+	return r.outputTs(), result
+}
+
+const (
+	boundLabel      = "__bound__"
+	boundLabelLower = "lower"
+	boundLabelMean  = "mean"
+	boundLabelUpper = "upper"
+)
+
+// AtConfidenceInterval returns per series the mean of the window values along with the bounds of
+// its confidence interval at the given level (e.g 0.95), as mean ± z*stddev/sqrt(n), distinguished
+// by the reserved `__bound__` label being either "lower", "mean" or "upper", which can't collide
+// with the labels of the series. Series with less than two samples only have their mean. Series
+// are filtered, rounded and tagged as by At.
+func (r *rangeVectorIterator) AtConfidenceInterval(level float64) (int64, promql.Vector) {
+	// two-sided critical value of the standard normal distribution.
+	z := math.Sqrt2 * math.Erfinv(level)
+	result := make(promql.Vector, 0, 3*len(r.window))
+	r.eachSeries(func(_ string, metric labels.Labels, points []promql.Point) {
+		mean, m2 := meanAndSquaredDeviations(points)
+		// the builder copies the labels, the cached series metric is left untouched.
+		lbs := labels.NewBuilder(metric)
+		result = append(result, r.output(lbs.Set(boundLabel, boundLabelMean).Labels(), mean))
+		n := float64(len(points))
+		if n < 2 {
+			return
+		}
+		margin := z * math.Sqrt(m2/(n-1)) / math.Sqrt(n)
+		result = append(result,
+			r.output(lbs.Set(boundLabel, boundLabelLower).Labels(), mean-margin),
+			r.output(lbs.Set(boundLabel, boundLabelUpper).Labels(), mean+margin),
+		)
+	})
+	return r.outputTs(), result
+}
+
+const partitionLabel = "__partition__"
+
+// AtPartitioned splits the window of each series into the points matching the predicate and the
+// others, e.g successes and failures, and returns the aggregate of both, distinguished by the
+// reserved `__partition__` label being either trueLabel or falseLabel, which can't collide with the
+// labels of the series. Both partitions are always aggregated, even when empty. Series are
+// filtered, rounded and tagged as by At. Window points are left untouched.
+func (r *rangeVectorIterator) AtPartitioned(pred func(float64) bool, aggregator RangeVectorAggregator, trueLabel, falseLabel string) (int64, promql.Vector) {
+	var (
+		result          = make(promql.Vector, 0, 2*len(r.window))
+		matched, others []promql.Point
+	)
+	r.eachSeries(func(_ string, metric labels.Labels, points []promql.Point) {
+		matched, others = matched[:0], others[:0]
+		for _, p := range points {
+			if pred(p.V) {
+				matched = append(matched, p)
+				continue
+			}
+			others = append(others, p)
+		}
+		// the builder copies the labels, the cached series metric is left untouched.
+		lbs := labels.NewBuilder(metric)
+		result = append(result,
+			r.output(lbs.Set(partitionLabel, trueLabel).Labels(), aggregator(matched)),
+			r.output(lbs.Set(partitionLabel, falseLabel).Labels(), aggregator(others)),
+		)
+	})
+	return r.outputTs(), result
+}
+
+// covers tells if the points span enough of the range.
+func (r *rangeVectorIterator) covers(points []promql.Point) bool {
+	span := points[len(points)-1].T - points[0].T
+	return float64(span) >= r.minCoverage*float64(r.selRange)
+}
+
+// accumulate adds the aggregates of the current window to the totals.
+func (r *rangeVectorIterator) accumulate() {
+	ts := r.outputTs()
+	r.eachSeries(func(lbs string, metric labels.Labels, points []promql.Point) {
+		v := r.totalsAgg(points)
+		total, ok := r.totals[lbs]
+		if !ok {
+			r.totals[lbs] = &promql.Sample{
+				Point:  promql.Point{T: ts, V: v},
+				Metric: metric,
+			}
+			return
+		}
+		total.T = ts
+		total.V += v
+	})
+}
+
+// Finalize returns per series the sum of the aggregated values of all steps, each stamped
+// with the series last step timestamp. It is meant to be called once Next returns false and
+// requires the iterator to be created withTotals.
+func (r *rangeVectorIterator) Finalize() promql.Vector {
+	result := make(promql.Vector, 0, len(r.totals))
+	for _, total := range r.totals {
+		result = append(result, *total)
+	}
+	return result
+}
+
+// backfillIterator seeds the leading empty windows of a query, up to the first non-empty one,
+// so that results start at the range start. Each series of the first non-empty window is
+// backfilled with the value returned by seed for that series first aggregate.
+type backfillIterator struct {
+	RangeVectorIterator
+	seed func(first float64) float64
+
+	started, inLeading, found bool
+	leading                   []int64
+}
+
+func newBackfillIterator(it RangeVectorIterator, seed func(first float64) float64) *backfillIterator {
+	return &backfillIterator{
+		RangeVectorIterator: it,
+		seed:                seed,
+	}
+}
+
+func (r *backfillIterator) Next() bool {
+	if !r.started {
+		r.started = true
+		// moves the underlying iterator to the first non-empty window.
+		for nextLoaded(r.RangeVectorIterator) {
+			ts, vec := r.RangeVectorIterator.At(countOverTime)
+			if len(vec) > 0 {
+				r.found = true
+				break
+			}
+			r.leading = append(r.leading, ts)
+		}
+		r.inLeading = len(r.leading) > 0
+		return r.inLeading || r.found
+	}
+	if r.inLeading {
+		r.leading = r.leading[1:]
+		if len(r.leading) > 0 {
+			return true
+		}
+		// the underlying iterator is already at the first non-empty window.
+		r.inLeading = false
+		return r.found
+	}
+	return nextLoaded(r.RangeVectorIterator)
+}
+
+func (r *backfillIterator) At(aggregator RangeVectorAggregator) (int64, promql.Vector) {
+	if !r.inLeading {
+		return r.RangeVectorIterator.At(aggregator)
+	}
+	ts := r.leading[0]
+	if !r.found {
+		return ts, promql.Vector{}
+	}
+	_, first := r.RangeVectorIterator.At(aggregator)
+	for i := range first {
+		first[i].T = ts
+		first[i].V = r.seed(first[i].V)
+	}
+	return ts, first
+}
+
+const (
+	seriesLabel         = "__series__"
+	seriesLabelRaw      = "raw"
+	seriesLabelSmoothed = "smoothed"
+)
+
+// smoothedIterator emits for each series both the raw aggregate and its exponential moving average
+// across steps, distinguished by the reserved `__series__` label being either "raw" or "smoothed",
+// which can't collide with the labels of the series.
+// Both are computed from a single window load. The average advances once per step, At can be
+// called again for the same step.
+type smoothedIterator struct {
+	RangeVectorIterator
+	alpha float64
+	// ema holds the averages up to the previous step, step those of the current step.
+	ema, step map[uint64]float64
+	ts        int64
+	started   bool
+}
+
+func newSmoothedIterator(it RangeVectorIterator, alpha float64) *smoothedIterator {
+	return &smoothedIterator{
+		RangeVectorIterator: it,
+		alpha:               alpha,
+		ema:                 map[uint64]float64{},
+		step:                map[uint64]float64{},
+	}
+}
+
+// Next skips the pending steps of the underlying iterator, the averages only advance over
+// loaded windows.
+func (r *smoothedIterator) Next() bool {
+	return nextLoaded(r.RangeVectorIterator)
+}
+
+func (r *smoothedIterator) At(aggregator RangeVectorAggregator) (int64, promql.Vector) {
+	ts, vec := r.RangeVectorIterator.At(aggregator)
+	if !r.started || ts != r.ts {
+		// commits the averages of the previous step.
+		for key, smoothed := range r.step {
+			r.ema[key] = smoothed
+		}
+		r.step = make(map[uint64]float64, len(vec))
+		r.ts, r.started = ts, true
+	}
+	result := make(promql.Vector, 0, 2*len(vec))
+	for _, s := range vec {
+		key := s.Metric.Hash()
+		smoothed, ok := r.ema[key]
+		if ok {
+			smoothed = r.alpha*s.V + (1-r.alpha)*smoothed
+		} else {
+			smoothed = s.V
+		}
+		r.step[key] = smoothed
+		// the builder copies the labels, the cached series metric is left untouched.
+		lbs := labels.NewBuilder(s.Metric)
+		result = append(result,
+			promql.Sample{
+				Point:  s.Point,
+				Metric: lbs.Set(seriesLabel, seriesLabelRaw).Labels(),
 			},
-			Metric: series.Metric,
-		})
+			promql.Sample{
+				Point:  promql.Point{T: ts, V: smoothed},
+				Metric: lbs.Set(seriesLabel, seriesLabelSmoothed).Labels(),
+			},
+		)
 	}
 	return ts, result
 }
 
+// activationCountEvaluator emits, per step, a single sample counting the series of the inner
+// iterator going from zero or absent to non-zero, i.e the streams becoming active.
+type activationCountEvaluator struct {
+	iter RangeVectorIterator
+	agg  RangeVectorAggregator
+	// active holds the hashes of the series non-zero at the previous step.
+	active map[uint64]struct{}
+}
+
+// NewActivationCountIterator returns a StepEvaluator counting per step the series activated since
+// the previous one. Series appearing for the first time with a non-zero value are activations.
+func NewActivationCountIterator(inner RangeVectorIterator, agg RangeVectorAggregator) StepEvaluator {
+	return &activationCountEvaluator{
+		iter:   inner,
+		agg:    agg,
+		active: map[uint64]struct{}{},
+	}
+}
+
+func (r *activationCountEvaluator) Next() (bool, int64, promql.Vector) {
+	if !nextLoaded(r.iter) {
+		return false, 0, promql.Vector{}
+	}
+	ts, vec := r.iter.At(r.agg)
+	var (
+		activations float64
+		active      = make(map[uint64]struct{}, len(vec))
+	)
+	for _, s := range vec {
+		if s.V == 0 {
+			continue
+		}
+		key := s.Metric.Hash()
+		if _, ok := r.active[key]; !ok {
+			activations++
+		}
+		active[key] = struct{}{}
+	}
+	r.active = active
+	return true, ts, promql.Vector{{Point: promql.Point{T: ts, V: activations}, Metric: labels.Labels{}}}
+}
+
+func (r *activationCountEvaluator) Close() error { return r.iter.Close() }
+
+func (r *activationCountEvaluator) Error() error { return r.iter.Error() }
+
+// BaselineMode is how baselineRelativeEvaluator expresses values against their baseline.
+type BaselineMode int
+
+const (
+	// BaselineRatio divides values by their baseline.
+	BaselineRatio BaselineMode = iota
+	// BaselineDifference subtracts their baseline from values.
+	BaselineDifference
+)
+
+// baselineRelativeEvaluator expresses the aggregates of each series of the inner iterator relative
+// to the first value of that series, its baseline.
+type baselineRelativeEvaluator struct {
+	iter      RangeVectorIterator
+	agg       RangeVectorAggregator
+	mode      BaselineMode
+	baselines map[uint64]float64
+}
+
+// NewBaselineRelativeIterator returns a StepEvaluator emitting the aggregates as a ratio or a
+// difference against the first non-NaN value of each series. Like the division binary operation,
+// a zero baseline results in NaN in ratio mode.
+func NewBaselineRelativeIterator(inner RangeVectorIterator, agg RangeVectorAggregator, mode BaselineMode) StepEvaluator {
+	return &baselineRelativeEvaluator{
+		iter:      inner,
+		agg:       agg,
+		mode:      mode,
+		baselines: map[uint64]float64{},
+	}
+}
+
+func (r *baselineRelativeEvaluator) Next() (bool, int64, promql.Vector) {
+	if !nextLoaded(r.iter) {
+		return false, 0, promql.Vector{}
+	}
+	ts, vec := r.iter.At(r.agg)
+	for i, s := range vec {
+		key := s.Metric.Hash()
+		baseline, ok := r.baselines[key]
+		if !ok {
+			if math.IsNaN(s.V) {
+				continue
+			}
+			baseline = s.V
+			r.baselines[key] = baseline
+		}
+		switch r.mode {
+		case BaselineDifference:
+			vec[i].V = s.V - baseline
+		default:
+			// guard against divide by zero
+			if baseline == 0 {
+				vec[i].V = math.NaN()
+				continue
+			}
+			vec[i].V = s.V / baseline
+		}
+	}
+	return true, ts, vec
+}
+
+func (r *baselineRelativeEvaluator) Close() error { return r.iter.Close() }
+
+func (r *baselineRelativeEvaluator) Error() error { return r.iter.Error() }
+
+// MultiRangeIterator iterates through multiple ranges of samples sharing the same steps.
+// To fetch the current vectors use `At` with one `RangeVectorAggregator` per range.
+type MultiRangeIterator interface {
+	Next() bool
+	// At returns one vector per range, in the order of the ranges, all stamped with the same timestamp.
+	At(aggregators []RangeVectorAggregator) (int64, []promql.Vector)
+	Close() error
+	Error() error
+}
+
+// multiRangeIterator loads a single window sized for the largest range and
+// narrows it down for each smaller range, so all ranges end at the same step timestamp.
+type multiRangeIterator struct {
+	*rangeVectorIterator
+	selRanges []int64
+}
+
+func newMultiRangeIterator(
+	it SeriesIterator,
+	selRanges []int64, step, start, end int64) *multiRangeIterator {
+	var maxRange int64
+	for _, selRange := range selRanges {
+		if selRange > maxRange {
+			maxRange = selRange
+		}
+	}
+	return &multiRangeIterator{
+		rangeVectorIterator: newRangeVectorIterator(it, maxRange, step, start, end),
+		selRanges:           selRanges,
+	}
+}
+
+func (r *multiRangeIterator) At(aggregators []RangeVectorAggregator) (int64, []promql.Vector) {
+	// convert ts from nano to milli seconds as the iterator work with nanoseconds
+	ts := r.current / 1e+6
+	result := make([]promql.Vector, 0, len(r.selRanges))
+	for i, selRange := range r.selRanges {
+		rangeStart := r.current - selRange
+		vec := make(promql.Vector, 0, len(r.window))
+		for _, series := range r.window {
+			// points are time ordered and the lower bound of the range is not inclusive.
+			first := sort.Search(len(series.Points), func(j int) bool {
+				return series.Points[j].T > rangeStart
+			})
+			if first == len(series.Points) {
+				continue
+			}
+			vec = append(vec, promql.Sample{
+				Point: promql.Point{
+					V: aggregators[i](series.Points[first:]),
+					T: ts,
+				},
+				Metric: series.Metric,
+			})
+		}
+		result = append(result, vec)
+	}
+	return ts, result
+}
+
+// SeriesID returns a stable identifier for the given series labels.
+// It hashes the canonical labels string with FNV-1a (64 bits) which, unlike map hashing,
+// doesn't change across Go versions or processes. This allows results computed by different
+// queriers to be merged by series identifier.
+func SeriesID(lbs labels.Labels) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(lbs.String()))
+	return h.Sum64()
+}
+
 var seriesPool sync.Pool
 
 func getSeries() *promql.Series {
@@ -0,0 +1,115 @@
+package logql
+
+import (
+	"math"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// decayingIterator aggregates each series into exponentially decayed accumulators instead of
+// storing its samples, using a constant amount of memory per series for long-running streaming
+// aggregations. A sample influence halves every halfLife, the result is an approximation of the
+// exponentially weighted sum (or average) of all samples up to the step rather than over a range.
+type decayingIterator struct {
+	iter                         SeriesIterator
+	halfLife, step, end, current int64
+	series                       map[string]*decayedSeries
+}
+
+type decayedSeries struct {
+	metric labels.Labels
+	// sum and weight are decayed as of the last sample timestamp.
+	sum, weight float64
+	last        int64
+}
+
+func newDecayingIterator(
+	it SeriesIterator,
+	halfLife, step, start, end int64) *decayingIterator {
+	// forces at least one step.
+	if step == 0 {
+		step = 1
+	}
+	return &decayingIterator{
+		iter:     it,
+		halfLife: halfLife,
+		step:     step,
+		end:      end,
+		current:  start - step, // first loop iteration will set it to start
+		series:   map[string]*decayedSeries{},
+	}
+}
+
+func (r *decayingIterator) Next() bool {
+	r.current = r.current + r.step
+	if r.current > r.end {
+		return false
+	}
+	for sample, hasNext := r.iter.Peek(); hasNext; sample, hasNext = r.iter.Peek() {
+		if sample.TimestampNano > r.current {
+			// not consuming the iterator as this belong to another step.
+			break
+		}
+		_ = r.iter.Next()
+		series, ok := r.series[sample.Labels]
+		if !ok {
+			metric, err := parser.ParseMetric(sample.Labels)
+			if err != nil {
+				continue
+			}
+			series = &decayedSeries{metric: metric, last: sample.TimestampNano}
+			r.series[sample.Labels] = series
+		}
+		decay := r.decay(sample.TimestampNano - series.last)
+		series.sum = series.sum*decay + sample.Value
+		series.weight = series.weight*decay + 1
+		series.last = sample.TimestampNano
+	}
+	return true
+}
+
+// decay returns the decay factor after the given elapsed nanoseconds.
+func (r *decayingIterator) decay(elapsed int64) float64 {
+	return math.Exp2(-float64(elapsed) / float64(r.halfLife))
+}
+
+// Sum returns the exponentially decayed sum of each series as of the current step.
+func (r *decayingIterator) Sum() (int64, promql.Vector) {
+	return r.at(func(s *decayedSeries, decay float64) float64 {
+		return s.sum * decay
+	})
+}
+
+// Avg returns the exponentially weighted average of each series as of the current step.
+func (r *decayingIterator) Avg() (int64, promql.Vector) {
+	return r.at(func(s *decayedSeries, _ float64) float64 {
+		// the decay cancels out.
+		return s.sum / s.weight
+	})
+}
+
+func (r *decayingIterator) at(value func(s *decayedSeries, decay float64) float64) (int64, promql.Vector) {
+	result := make(promql.Vector, 0, len(r.series))
+	// convert ts from nano to milli seconds as the iterator work with nanoseconds
+	ts := r.current / 1e+6
+	for _, s := range r.series {
+		result = append(result, promql.Sample{
+			Point: promql.Point{
+				V: value(s, r.decay(r.current-s.last)),
+				T: ts,
+			},
+			Metric: s.metric,
+		})
+	}
+	return ts, result
+}
+
+func (r *decayingIterator) Close() error {
+	return r.iter.Close()
+}
+
+func (r *decayingIterator) Error() error {
+	return r.iter.Error()
+}
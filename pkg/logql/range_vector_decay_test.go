@@ -0,0 +1,46 @@
+package logql
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_DecayingIterator(t *testing.T) {
+	var samples []Sample
+	for i := 1; i <= 1000; i++ {
+		samples = append(samples, Sample{
+			Labels:        `{app="foo"}`,
+			TimestampNano: time.Unix(int64(i), 0).UnixNano(),
+			Value:         float64(i % 7),
+		})
+	}
+	halfLife := (60 * time.Second).Nanoseconds()
+	it := newDecayingIterator(newSliceSeriesIterator(samples...), halfLife,
+		(100 * time.Second).Nanoseconds(), time.Unix(100, 0).UnixNano(), time.Unix(1000, 0).UnixNano())
+
+	for it.Next() {
+		// the exact exponentially weighted values over all samples so far.
+		var sum, weight float64
+		for _, s := range samples {
+			if s.TimestampNano > it.current {
+				break
+			}
+			w := math.Exp2(-float64(it.current-s.TimestampNano) / float64(halfLife))
+			sum += s.Value * w
+			weight += w
+		}
+
+		ts, v := it.Sum()
+		require.Equal(t, it.current/1e+6, ts)
+		require.Len(t, v, 1)
+		require.Equal(t, labelFoo, v[0].Metric)
+		require.InDelta(t, sum, v[0].V, 1e-6)
+		_, v = it.Avg()
+		require.InDelta(t, sum/weight, v[0].V, 1e-9)
+	}
+	// a single accumulator is kept per series.
+	require.Len(t, it.series, 1)
+}
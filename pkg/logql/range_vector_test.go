@@ -3,9 +3,13 @@ package logql
 import (
 	"context"
 	"fmt"
+	"math"
+	"strconv"
 	"testing"
 	"time"
+	"unsafe"
 
+	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/stretchr/testify/require"
@@ -166,3 +170,1186 @@ func Test_RangeVectorIterator(t *testing.T) {
 			})
 	}
 }
+
+func Test_SeriesID(t *testing.T) {
+	// Those values must never change, series identifiers are compared across queriers.
+	for _, tt := range []struct {
+		labels   string
+		expected uint64
+	}{
+		{`{}`, 645223143103797797},
+		{`{app="foo"}`, 8300851366568855551},
+		{`{app="bar"}`, 7029112201809117522},
+		{`{env="prod", app="foo"}`, 1571243141323897640},
+	} {
+		t.Run(tt.labels, func(t *testing.T) {
+			lbs, err := parser.ParseMetric(tt.labels)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, SeriesID(lbs))
+		})
+	}
+}
+
+func Test_MultiRangeIterator(t *testing.T) {
+	it := newMultiRangeIterator(newfakeSeriesIterator(),
+		[]int64{(10 * time.Second).Nanoseconds(), (30 * time.Second).Nanoseconds()},
+		(30 * time.Second).Nanoseconds(), time.Unix(10, 0).UnixNano(), time.Unix(100, 0).UnixNano())
+
+	expectedTs := []time.Time{time.Unix(10, 0), time.Unix(40, 0), time.Unix(70, 0), time.Unix(100, 0)}
+	expected := [][]float64{{4, 4}, {3, 5}, {0, 0}, {1, 1}}
+
+	i := 0
+	for it.Next() {
+		ts, vecs := it.At([]RangeVectorAggregator{countOverTime, countOverTime})
+		require.Equal(t, expectedTs[i].UnixNano()/1e+6, ts)
+		require.Len(t, vecs, 2)
+		for j, vec := range vecs {
+			if expected[i][j] == 0 {
+				require.Empty(t, vec)
+				continue
+			}
+			require.ElementsMatch(t, promql.Vector{
+				{Point: newPoint(expectedTs[i], expected[i][j]), Metric: labelBar},
+				{Point: newPoint(expectedTs[i], expected[i][j]), Metric: labelFoo},
+			}, vec)
+		}
+		i++
+	}
+	require.Equal(t, len(expectedTs), i)
+}
+
+func Test_BackfillIterator(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		seed     func(float64) float64
+		expected []float64
+	}{
+		{"zero", func(float64) float64 { return 0 }, []float64{0, 0, 4, 5}},
+		{"first", func(first float64) float64 { return first }, []float64{4, 4, 4, 5}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// data only starts at the third step.
+			it := newBackfillIterator(newRangeVectorIterator(newfakeSeriesIterator(),
+				(30*time.Second).Nanoseconds(), (30*time.Second).Nanoseconds(),
+				time.Unix(-50, 0).UnixNano(), time.Unix(40, 0).UnixNano()), tt.seed)
+			expectedTs := []time.Time{time.Unix(-50, 0), time.Unix(-20, 0), time.Unix(10, 0), time.Unix(40, 0)}
+
+			i := 0
+			for it.Next() {
+				ts, v := it.At(countOverTime)
+				require.Equal(t, expectedTs[i].UnixNano()/1e+6, ts)
+				require.ElementsMatch(t, promql.Vector{
+					{Point: newPoint(expectedTs[i], tt.expected[i]), Metric: labelBar},
+					{Point: newPoint(expectedTs[i], tt.expected[i]), Metric: labelFoo},
+				}, v)
+				i++
+			}
+			require.Equal(t, len(expectedTs), i)
+		})
+	}
+
+	t.Run("no data", func(t *testing.T) {
+		it := newBackfillIterator(newRangeVectorIterator(newfakeSeriesIterator(),
+			(30*time.Second).Nanoseconds(), (30*time.Second).Nanoseconds(),
+			time.Unix(-80, 0).UnixNano(), time.Unix(-20, 0).UnixNano()), func(float64) float64 { return 0 })
+		i := 0
+		for it.Next() {
+			_, v := it.At(countOverTime)
+			require.Empty(t, v)
+			i++
+		}
+		require.Equal(t, 3, i)
+	})
+}
+
+func Test_SmoothedIterator(t *testing.T) {
+	it := newSmoothedIterator(newRangeVectorIterator(newfakeSeriesIterator(),
+		(30*time.Second).Nanoseconds(), (30*time.Second).Nanoseconds(),
+		time.Unix(10, 0).UnixNano(), time.Unix(100, 0).UnixNano()), 0.5)
+
+	// raw values of the window are 4, 5, (empty), 1.
+	expectedTs := []time.Time{time.Unix(10, 0), time.Unix(40, 0), time.Unix(100, 0)}
+	expectedRaw := []float64{4, 5, 1}
+	expectedSmoothed := []float64{4, 4.5, 2.75}
+
+	i := 0
+	for it.Next() {
+		_, v := it.At(countOverTime)
+		if len(v) == 0 {
+			continue
+		}
+		// the average advances once per step.
+		_, again := it.At(countOverTime)
+		require.ElementsMatch(t, v, again)
+		var expected promql.Vector
+		for _, lbs := range []labels.Labels{labelBar, labelFoo} {
+			b := labels.NewBuilder(lbs)
+			expected = append(expected,
+				promql.Sample{Point: newPoint(expectedTs[i], expectedRaw[i]), Metric: b.Set(seriesLabel, "raw").Labels()},
+				promql.Sample{Point: newPoint(expectedTs[i], expectedSmoothed[i]), Metric: b.Set(seriesLabel, "smoothed").Labels()},
+			)
+		}
+		require.ElementsMatch(t, expected, v)
+		i++
+	}
+	require.Equal(t, len(expectedTs), i)
+
+	// a series label of the source is kept.
+	it = newSmoothedIterator(newRangeVectorIterator(newSliceSeriesIterator(
+		Sample{Labels: `{app="foo", series="a"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 1},
+	), (10*time.Second).Nanoseconds(), (10*time.Second).Nanoseconds(),
+		time.Unix(10, 0).UnixNano(), time.Unix(10, 0).UnixNano()), 0.5)
+	require.True(t, it.Next())
+	_, v := it.At(countOverTime)
+	require.Equal(t, map[string]float64{
+		`{__series__="raw", app="foo", series="a"}`:      1,
+		`{__series__="smoothed", app="foo", series="a"}`: 1,
+	}, vectorValues(v))
+}
+
+// sliceSeriesIterator is a SeriesIterator over a slice of time ordered samples.
+type sliceSeriesIterator struct {
+	samples []Sample
+	cur     int
+}
+
+func newSliceSeriesIterator(samples ...Sample) *sliceSeriesIterator {
+	return &sliceSeriesIterator{samples: samples}
+}
+
+func (s *sliceSeriesIterator) Next() bool {
+	s.cur++
+	return s.cur < len(s.samples)
+}
+
+func (s *sliceSeriesIterator) Peek() (Sample, bool) {
+	if s.cur >= len(s.samples) {
+		return Sample{}, false
+	}
+	return s.samples[s.cur], true
+}
+
+func (s *sliceSeriesIterator) Close() error { return nil }
+
+func (s *sliceSeriesIterator) Error() error { return nil }
+
+func Test_RangeVectorIteratorPointsGrowth(t *testing.T) {
+	it := newRangeVectorIterator(newSliceSeriesIterator(), 0, 0, 0, 0, withPointsGrowth(0.25))
+	series := &promql.Series{Points: make([]promql.Point, 0, 8)}
+	for i := 0; i < 11; i++ {
+		it.appendPoint(series, promql.Point{T: int64(i), V: 1})
+	}
+	require.Len(t, series.Points, 11)
+	// 8 grows to 10 then 12.
+	require.Equal(t, 12, cap(series.Points))
+	for i, p := range series.Points {
+		require.Equal(t, int64(i), p.T)
+	}
+}
+
+// BenchmarkRangeVectorIteratorPointsGrowth compares the peak memory of appending 1M points to a
+// window series as load does, the transient peak being reached while growing, when both the old
+// and the new backing arrays are alive.
+func BenchmarkRangeVectorIteratorPointsGrowth(b *testing.B) {
+	const size = 1000000
+	pointSize := int(unsafe.Sizeof(promql.Point{}))
+	for _, growth := range []float64{0, 0.25, 0.1} {
+		b.Run(fmt.Sprintf("growth=%v", growth), func(b *testing.B) {
+			b.ReportAllocs()
+			var peak, final int
+			for i := 0; i < b.N; i++ {
+				var opts []rangeVectorIteratorOption
+				if growth > 0 {
+					opts = append(opts, withPointsGrowth(growth))
+				}
+				it := newRangeVectorIterator(newSliceSeriesIterator(), size, size, size, size, opts...)
+				series := &promql.Series{}
+				peak = 0
+				for j := 1; j <= size; j++ {
+					before := cap(series.Points)
+					it.appendPoint(series, promql.Point{T: int64(j), V: 1})
+					if after := cap(series.Points); after != before && before+after > peak {
+						peak = before + after
+					}
+				}
+				final = cap(series.Points)
+			}
+			b.ReportMetric(float64(peak*pointSize), "peak-bytes")
+			b.ReportMetric(float64(final*pointSize), "final-bytes")
+		})
+	}
+}
+
+func Test_RangeVectorIteratorFinalize(t *testing.T) {
+	it := newRangeVectorIterator(newfakeSeriesIterator(),
+		(30 * time.Second).Nanoseconds(), (30 * time.Second).Nanoseconds(),
+		time.Unix(10, 0).UnixNano(), time.Unix(100, 0).UnixNano(), withTotals(countOverTime))
+	for it.Next() {
+		// totals do not depend on the calls to At.
+		_, _ = it.At(countOverTime)
+		_, _ = it.At(sumOverTime)
+	}
+	// 4 + 5 + 0 + 1
+	expected := promql.Vector{
+		{Point: newPoint(time.Unix(100, 0), 10), Metric: labelBar},
+		{Point: newPoint(time.Unix(100, 0), 10), Metric: labelFoo},
+	}
+	require.ElementsMatch(t, expected, it.Finalize())
+
+	// the backfill iterator probes windows with At.
+	it = newRangeVectorIterator(newfakeSeriesIterator(),
+		(30 * time.Second).Nanoseconds(), (30 * time.Second).Nanoseconds(),
+		time.Unix(10, 0).UnixNano(), time.Unix(100, 0).UnixNano(), withTotals(countOverTime))
+	backfill := newBackfillIterator(it, func(first float64) float64 { return first })
+	for backfill.Next() {
+		_, _ = backfill.At(countOverTime)
+	}
+	require.ElementsMatch(t, expected, it.Finalize())
+}
+
+func Test_RangeVectorIteratorRetentionStart(t *testing.T) {
+	it := newRangeVectorIterator(newfakeSeriesIterator(),
+		(30 * time.Second).Nanoseconds(), (30 * time.Second).Nanoseconds(),
+		time.Unix(10, 0).UnixNano(), time.Unix(100, 0).UnixNano(), withRetentionStart(time.Unix(0, 0).Add(time.Second).UnixNano()))
+	require.Equal(t, []string{
+		"the first window starts at 1969-12-31T23:59:40Z before the retention start 1970-01-01T00:00:01Z, leading results may be sparse",
+	}, it.Warnings())
+
+	it = newRangeVectorIterator(newfakeSeriesIterator(),
+		(30 * time.Second).Nanoseconds(), (30 * time.Second).Nanoseconds(),
+		time.Unix(40, 0).UnixNano(), time.Unix(100, 0).UnixNano(), withRetentionStart(time.Unix(0, 0).Add(time.Second).UnixNano()))
+	require.Empty(t, it.Warnings())
+}
+
+// slowSeriesIterator delays the first peeks of a SeriesIterator.
+type slowSeriesIterator struct {
+	SeriesIterator
+	delay     time.Duration
+	slowPeeks int
+}
+
+func (s *slowSeriesIterator) Peek() (Sample, bool) {
+	if s.slowPeeks > 0 {
+		s.slowPeeks--
+		time.Sleep(s.delay)
+	}
+	return s.SeriesIterator.Peek()
+}
+
+func Test_RangeVectorIteratorStepTimeout(t *testing.T) {
+	newIterator := func(slowPeeks int) *rangeVectorIterator {
+		return newRangeVectorIterator(&slowSeriesIterator{
+			SeriesIterator: newfakeSeriesIterator(),
+			delay:          50 * time.Millisecond,
+			slowPeeks:      slowPeeks,
+		}, (30 * time.Second).Nanoseconds(), (30 * time.Second).Nanoseconds(),
+			time.Unix(10, 0).UnixNano(), time.Unix(40, 0).UnixNano(), withStepTimeout(10*time.Millisecond))
+	}
+	expected := promql.Vector{
+		{Point: newPoint(time.Unix(10, 0), 4), Metric: labelBar},
+		{Point: newPoint(time.Unix(10, 0), 4), Metric: labelFoo},
+	}
+
+	t.Run("resumed", func(t *testing.T) {
+		it := newIterator(1)
+		var consumed int
+		it.Register(func(WindowSnapshot) { consumed++ })
+		// the first load times out, the step is pending.
+		require.True(t, it.Next())
+		require.True(t, it.Pending())
+		require.False(t, it.Partial())
+		require.Equal(t, 0, consumed)
+		// the following call resumes the load of the same step.
+		require.True(t, it.Next())
+		require.False(t, it.Pending())
+		require.False(t, it.Partial())
+		require.Equal(t, 1, consumed)
+		ts, v := it.At(countOverTime)
+		require.Equal(t, time.Unix(10, 0).UnixNano()/1e+6, ts)
+		require.ElementsMatch(t, expected, v)
+		// the iteration carries on with the next step.
+		require.True(t, it.Next())
+		require.False(t, it.Pending())
+		ts, _ = it.At(countOverTime)
+		require.Equal(t, time.Unix(40, 0).UnixNano()/1e+6, ts)
+		require.False(t, it.Next())
+	})
+
+	t.Run("partial", func(t *testing.T) {
+		it := newIterator(2)
+		require.True(t, it.Next())
+		require.True(t, it.Pending())
+		require.True(t, it.Next())
+		require.False(t, it.Pending())
+		require.True(t, it.Partial())
+		_, v := it.At(countOverTime)
+		require.ElementsMatch(t, promql.Vector{
+			{Point: newPoint(time.Unix(10, 0), 1), Metric: labelBar},
+			{Point: newPoint(time.Unix(10, 0), 1), Metric: labelFoo},
+		}, v)
+	})
+
+	t.Run("matrix", func(t *testing.T) {
+		// each step is emitted once, whether it was resumed or not.
+		m, err := EvalToMatrix(newIterator(1), countOverTime, 0)
+		require.NoError(t, err)
+		require.Equal(t, promql.Matrix{
+			{Metric: labelBar, Points: []promql.Point{{T: 10000, V: 4}, {T: 40000, V: 5}}},
+			{Metric: labelFoo, Points: []promql.Point{{T: 10000, V: 4}, {T: 40000, V: 5}}},
+		}, m)
+	})
+
+	t.Run("wrapped", func(t *testing.T) {
+		// wrapping iterators skip the pending steps too.
+		it := newSmoothedIterator(newIterator(1), 0.5)
+		require.True(t, it.Next())
+		ts, _ := it.At(countOverTime)
+		require.Equal(t, time.Unix(10, 0).UnixNano()/1e+6, ts)
+		require.True(t, it.Next())
+		ts, _ = it.At(countOverTime)
+		require.Equal(t, time.Unix(40, 0).UnixNano()/1e+6, ts)
+		require.False(t, it.Next())
+	})
+
+	t.Run("rejected samples", func(t *testing.T) {
+		// the deadline is checked before reading the samples following rejected ones.
+		it := newRangeVectorIterator(&slowSeriesIterator{
+			SeriesIterator: newSliceSeriesIterator(
+				Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 1},
+				Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(2, 0).UnixNano(), Value: 1},
+				Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(3, 0).UnixNano(), Value: 1},
+				Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(15, 0).UnixNano(), Value: 1},
+			),
+			delay:     50 * time.Millisecond,
+			slowPeeks: 2,
+		}, (5 * time.Second).Nanoseconds(), (5 * time.Second).Nanoseconds(),
+			time.Unix(20, 0).UnixNano(), time.Unix(20, 0).UnixNano(), withStepTimeout(10*time.Millisecond))
+		require.True(t, it.Next())
+		require.True(t, it.Pending())
+		require.True(t, it.Next())
+		require.True(t, it.Partial())
+		_, v := it.At(countOverTime)
+		require.Empty(t, v)
+	})
+}
+
+func Test_RangeVectorIteratorRejectedEarlySamples(t *testing.T) {
+	it := newRangeVectorIterator(newSliceSeriesIterator(
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 100},
+		// the first window start is not inclusive, but returned by correct sources.
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(10, 0).UnixNano(), Value: 100},
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(11, 0).UnixNano(), Value: 1},
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(20, 0).UnixNano(), Value: 2},
+	), (10 * time.Second).Nanoseconds(), (10 * time.Second).Nanoseconds(),
+		time.Unix(20, 0).UnixNano(), time.Unix(20, 0).UnixNano())
+
+	require.True(t, it.Next())
+	_, v := it.At(sumOverTime)
+	require.Equal(t, promql.Vector{{Point: newPoint(time.Unix(20, 0), 3), Metric: labelFoo}}, v)
+	require.Equal(t, 1, it.RejectedEarlySamples())
+	require.False(t, it.Next())
+}
+
+func Test_RangeVectorIteratorConsumers(t *testing.T) {
+	it := newRangeVectorIterator(newSliceSeriesIterator(
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 2},
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(2, 0).UnixNano(), Value: 3},
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(3, 0).UnixNano(), Value: 4},
+	), (2 * time.Second).Nanoseconds(), time.Second.Nanoseconds(), time.Unix(2, 0).UnixNano(), time.Unix(3, 0).UnixNano())
+
+	var counts, sums []promql.Vector
+	it.Register(func(s WindowSnapshot) { counts = append(counts, s.Aggregate(countOverTime)) })
+	// consumers can be registered while iterating.
+	require.True(t, it.Next())
+	it.Register(func(s WindowSnapshot) { sums = append(sums, s.Aggregate(sumOverTime)) })
+	require.True(t, it.Next())
+	require.False(t, it.Next())
+
+	require.Equal(t, []promql.Vector{
+		{{Point: newPoint(time.Unix(2, 0), 2), Metric: labelFoo}},
+		{{Point: newPoint(time.Unix(3, 0), 2), Metric: labelFoo}},
+	}, counts)
+	require.Equal(t, []promql.Vector{
+		{{Point: newPoint(time.Unix(3, 0), 7), Metric: labelFoo}},
+	}, sums)
+}
+
+func Test_RangeVectorIteratorMinCoverage(t *testing.T) {
+	it := newRangeVectorIterator(newSliceSeriesIterator(
+		Sample{Labels: `{app="bar"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 1},
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(3, 0).UnixNano(), Value: 1},
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(5, 0).UnixNano(), Value: 1},
+		Sample{Labels: `{app="bar"}`, TimestampNano: time.Unix(9, 0).UnixNano(), Value: 1},
+	), (10 * time.Second).Nanoseconds(), (10 * time.Second).Nanoseconds(),
+		time.Unix(10, 0).UnixNano(), time.Unix(10, 0).UnixNano(), withMinCoverage(0.5))
+
+	require.True(t, it.Next())
+	// foo only spans 20% of the range.
+	_, v := it.At(countOverTime)
+	require.Equal(t, promql.Vector{{Point: newPoint(time.Unix(10, 0), 2), Metric: labelBar}}, v)
+}
+
+type mockSpan struct {
+	name       string
+	attributes map[string]interface{}
+	ended      bool
+}
+
+func (s *mockSpan) SetAttribute(key string, value interface{}) { s.attributes[key] = value }
+
+func (s *mockSpan) End() { s.ended = true }
+
+type mockTracer struct {
+	spans []*mockSpan
+}
+
+func (t *mockTracer) StartSpan(name string) Span {
+	s := &mockSpan{name: name, attributes: map[string]interface{}{}}
+	t.spans = append(t.spans, s)
+	return s
+}
+
+func Test_RangeVectorIteratorTracer(t *testing.T) {
+	tracer := &mockTracer{}
+	it := newRangeVectorIterator(newfakeSeriesIterator(),
+		(30 * time.Second).Nanoseconds(), (30 * time.Second).Nanoseconds(),
+		time.Unix(10, 0).UnixNano(), time.Unix(100, 0).UnixNano(), withTracer(tracer))
+
+	for _, expected := range []struct {
+		step            time.Time
+		samples, series int
+	}{
+		{time.Unix(10, 0), 8, 2},
+		{time.Unix(40, 0), 10, 2},
+		{time.Unix(70, 0), 0, 0},
+	} {
+		require.True(t, it.Next())
+		span := tracer.spans[len(tracer.spans)-1]
+		require.False(t, span.ended)
+		require.Equal(t, "rangeVectorIterator.Next", span.name)
+		require.Equal(t, expected.step.UnixNano()/1e+6, span.attributes["step"])
+		require.Equal(t, expected.samples, span.attributes["samples"])
+		require.Equal(t, expected.series, span.attributes["series"])
+		require.IsType(t, time.Duration(0), span.attributes["load_duration"])
+	}
+	// closing early ends the current span.
+	require.NoError(t, it.Close())
+	require.Len(t, tracer.spans, 3)
+	for _, s := range tracer.spans {
+		require.True(t, s.ended)
+	}
+}
+
+func Test_RangeVectorIteratorMaxMagnitude(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		policy   magnitudePolicy
+		expected float64
+	}{
+		{"reject", magnitudeReject, 6},
+		{"clamp", magnitudeClamp, 6 - 1000},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			it := newRangeVectorIterator(newSliceSeriesIterator(
+				Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 1},
+				Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(2, 0).UnixNano(), Value: -1e300},
+				Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(3, 0).UnixNano(), Value: 2},
+				Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(4, 0).UnixNano(), Value: 3},
+			), (10 * time.Second).Nanoseconds(), (10 * time.Second).Nanoseconds(),
+				time.Unix(10, 0).UnixNano(), time.Unix(10, 0).UnixNano(), withMaxMagnitude(1000, tt.policy))
+
+			require.True(t, it.Next())
+			_, v := it.At(sumOverTime)
+			require.Equal(t, promql.Vector{{Point: newPoint(time.Unix(10, 0), tt.expected), Metric: labelFoo}}, v)
+			require.Equal(t, 1, it.OutOfMagnitudeSamples())
+		})
+	}
+}
+
+func Test_RangeVectorIteratorWindowSizeHistogram(t *testing.T) {
+	var samples []Sample
+	// 5 samples in the first second, 50 in the third and 150 in the fifth, none in the others.
+	for i := 0; i < 5; i++ {
+		samples = append(samples, Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(0, 100+int64(i)).UnixNano(), Value: 1})
+	}
+	for i := 0; i < 50; i++ {
+		samples = append(samples, Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(2, 100+int64(i)).UnixNano(), Value: 1})
+	}
+	for i := 0; i < 150; i++ {
+		samples = append(samples, Sample{Labels: `{app="bar"}`, TimestampNano: time.Unix(4, 100+int64(i)).UnixNano(), Value: 1})
+	}
+	it := newRangeVectorIterator(newSliceSeriesIterator(samples...), time.Second.Nanoseconds(), time.Second.Nanoseconds(),
+		time.Unix(1, 0).UnixNano(), time.Unix(5, 0).UnixNano())
+	for it.Next() {
+	}
+	require.Equal(t, map[string]int{"0": 2, "1-10": 1, "11-100": 1, "101-1000": 1}, it.WindowSizeHistogram())
+
+	require.Equal(t, 0, windowSizeBucket(0))
+	require.Equal(t, 1, windowSizeBucket(10))
+	require.Equal(t, 2, windowSizeBucket(11))
+	require.Equal(t, 4, windowSizeBucket(1001))
+}
+
+func Test_RangeVectorIteratorProgress(t *testing.T) {
+	var (
+		partials []float64
+		steps    []int64
+	)
+	it := newRangeVectorIterator(&slowSeriesIterator{
+		SeriesIterator: newfakeSeriesIterator(),
+		delay:          5 * time.Millisecond,
+		slowPeeks:      100,
+	}, (30 * time.Second).Nanoseconds(), (30 * time.Second).Nanoseconds(),
+		time.Unix(10, 0).UnixNano(), time.Unix(10, 0).UnixNano(),
+		withProgress(time.Millisecond, IncrementalCount, func(ts int64, partial promql.Vector) {
+			var count float64
+			for _, s := range partial {
+				count += s.V
+			}
+			steps = append(steps, ts)
+			partials = append(partials, count)
+		}))
+
+	require.True(t, it.Next())
+	require.True(t, len(partials) > 1)
+	for i := range partials {
+		require.Equal(t, time.Unix(10, 0).UnixNano()/1e+6, steps[i])
+		if i > 0 {
+			require.Greater(t, partials[i], partials[i-1])
+		}
+	}
+	require.LessOrEqual(t, partials[len(partials)-1], 8.)
+}
+
+func Test_RangeVectorIteratorAtInto(t *testing.T) {
+	it := newRangeVectorIterator(newSliceSeriesIterator(
+		Sample{Labels: `{app="bar"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 1},
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 1},
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(2, 0).UnixNano(), Value: 1},
+	), time.Second.Nanoseconds(), time.Second.Nanoseconds(), time.Unix(1, 0).UnixNano(), time.Unix(2, 0).UnixNano())
+
+	var buf promql.Vector
+	require.True(t, it.Next())
+	_, buf = it.AtInto(countOverTime, buf)
+	require.Len(t, buf, 2)
+	require.True(t, it.Next())
+	ts, v := it.AtInto(countOverTime, buf)
+	require.Equal(t, time.Unix(2, 0).UnixNano()/1e+6, ts)
+	require.Equal(t, promql.Vector{{Point: newPoint(time.Unix(2, 0), 1), Metric: labelFoo}}, v)
+	// the buffer memory is reused.
+	require.Equal(t, &buf[0], &v[0])
+}
+
+func BenchmarkRangeVectorIteratorAtInto(b *testing.B) {
+	// the amount of series increases at each step.
+	var samples []Sample
+	for step := 1; step <= 100; step++ {
+		for i := 0; i < 10*step; i++ {
+			samples = append(samples, Sample{
+				Labels:        fmt.Sprintf(`{app="foo", i="%d"}`, i),
+				TimestampNano: time.Unix(int64(step), 0).UnixNano(),
+				Value:         1,
+			})
+		}
+	}
+	newIterator := func() *rangeVectorIterator {
+		return newRangeVectorIterator(newSliceSeriesIterator(samples...), time.Second.Nanoseconds(), time.Second.Nanoseconds(),
+			time.Unix(1, 0).UnixNano(), time.Unix(100, 0).UnixNano())
+	}
+	// compares the allocations of the result buffer, with and without the rolling maximum.
+	for _, tc := range []struct {
+		name string
+		at   func(it *rangeVectorIterator, buf promql.Vector) promql.Vector
+	}{
+		{"presized", func(it *rangeVectorIterator, buf promql.Vector) promql.Vector {
+			_, buf = it.AtInto(countOverTime, buf)
+			return buf
+		}},
+		{"reused", func(it *rangeVectorIterator, buf promql.Vector) promql.Vector {
+			_, buf = it.at(countOverTime, buf[:0])
+			return buf
+		}},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			// only the result buffer allocations are measured, not the windows loads.
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				it := newIterator()
+				var buf promql.Vector
+				for it.Next() {
+					b.StartTimer()
+					buf = tc.at(it, buf)
+					b.StopTimer()
+				}
+			}
+		})
+	}
+}
+
+func Test_RangeVectorIteratorTimeOfDayBucket(t *testing.T) {
+	hourOfDay := func(ts int64) string {
+		return strconv.Itoa(time.Unix(0, ts*1e+6).UTC().Hour())
+	}
+	it := newRangeVectorIterator(newSliceSeriesIterator(
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(3000, 0).UnixNano(), Value: 1},
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(7000, 0).UnixNano(), Value: 1},
+	), time.Hour.Nanoseconds(), time.Hour.Nanoseconds(),
+		time.Unix(3600, 0).UnixNano(), time.Unix(7200, 0).UnixNano(), withTimeOfDayBucket(hourOfDay))
+
+	for _, hour := range []string{"1", "2"} {
+		require.True(t, it.Next())
+		_, v := it.At(countOverTime)
+		require.Len(t, v, 1)
+		require.Equal(t, labels.Labels{{Name: "__tod_bucket__", Value: hour}, {Name: "app", Value: "foo"}}, v[0].Metric)
+	}
+	// cached metrics are not mutated.
+	require.Equal(t, labelFoo, it.metrics[`{app="foo"}`])
+}
+
+func Test_RangeVectorIteratorRounding(t *testing.T) {
+	it := newRangeVectorIterator(newSliceSeriesIterator(
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 1.2345},
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(2, 0).UnixNano(), Value: 2},
+	), (10 * time.Second).Nanoseconds(), (10 * time.Second).Nanoseconds(),
+		time.Unix(10, 0).UnixNano(), time.Unix(10, 0).UnixNano(), withRounding(2))
+
+	require.True(t, it.Next())
+	_, v := it.At(sumOverTime)
+	require.Equal(t, promql.Vector{{Point: newPoint(time.Unix(10, 0), 3.23), Metric: labelFoo}}, v)
+	// the raw aggregation is unaffected.
+	require.InDelta(t, 3.2345, it.Snapshot().Aggregate(sumOverTime)[0].V, 1e-9)
+
+	_, v = it.At(func([]promql.Point) float64 { return math.Inf(1) })
+	require.True(t, math.IsInf(v[0].V, 1))
+	_, v = it.At(func([]promql.Point) float64 { return math.NaN() })
+	require.True(t, math.IsNaN(v[0].V))
+	// large values are left unchanged rather than overflowing.
+	for _, large := range []float64{1e307, -1e307, math.MaxFloat64, 1e17 + 0.5} {
+		_, v = it.At(func([]promql.Point) float64 { return large })
+		require.Equal(t, large, v[0].V)
+	}
+
+	// rounding scaling to infinity leaves values unchanged.
+	it = newRangeVectorIterator(newSliceSeriesIterator(
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 1.5},
+	), (10 * time.Second).Nanoseconds(), (10 * time.Second).Nanoseconds(),
+		time.Unix(10, 0).UnixNano(), time.Unix(10, 0).UnixNano(), withRounding(400))
+	require.True(t, it.Next())
+	_, v = it.At(sumOverTime)
+	require.Equal(t, 1.5, v[0].V)
+}
+
+func Test_RangeVectorIteratorLocks(t *testing.T) {
+	locks := newIteratorLocks(1)
+	newIterator := func(ctx context.Context) *rangeVectorIterator {
+		return newRangeVectorIterator(newfakeSeriesIterator(),
+			(30 * time.Second).Nanoseconds(), (30 * time.Second).Nanoseconds(),
+			time.Unix(10, 0).UnixNano(), time.Unix(100, 0).UnixNano(), withLocks(ctx, locks))
+	}
+
+	first := newIterator(context.Background())
+	require.True(t, first.Next())
+
+	second := newIterator(context.Background())
+	loaded := make(chan bool)
+	go func() {
+		loaded <- second.Next()
+	}()
+	select {
+	case <-loaded:
+		t.Fatal("second iterator loaded while the first holds the lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// the lock is kept across steps.
+	require.True(t, first.Next())
+	require.NoError(t, first.Close())
+	require.True(t, <-loaded)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	third := newIterator(ctx)
+	require.False(t, third.Next())
+	require.Equal(t, context.Canceled, third.Error())
+
+	require.NoError(t, second.Close())
+	require.Len(t, locks, 1)
+}
+
+func Test_RangeVectorIteratorPreAggregation(t *testing.T) {
+	// a sample every 100ms for a minute, 50ms after the tenth of second.
+	var samples []Sample
+	for i := 0; i < 600; i++ {
+		samples = append(samples, Sample{Labels: `{app="foo"}`, TimestampNano: int64(i)*(100*time.Millisecond).Nanoseconds() + (50 * time.Millisecond).Nanoseconds(), Value: 1})
+	}
+	newIterator := func(step time.Duration, opts ...rangeVectorIteratorOption) *rangeVectorIterator {
+		return newRangeVectorIterator(newSliceSeriesIterator(samples...), (5 * time.Second).Nanoseconds(),
+			step.Nanoseconds(), time.Unix(5, 0).UnixNano(), time.Unix(60, 0).UnixNano(), opts...)
+	}
+	for _, tc := range []struct {
+		step time.Duration
+		// the maximum error, in samples.
+		delta float64
+	}{
+		// windows start at bucket boundaries, buckets are either in or out.
+		{time.Second, 0},
+		// the bucket straddling the window start leaves with its first sample.
+		{1250 * time.Millisecond, 9},
+	} {
+		t.Run(tc.step.String(), func(t *testing.T) {
+			var progress float64
+			exact := newIterator(tc.step)
+			bucketed := newIterator(tc.step, withPreAggregation(time.Second.Nanoseconds()),
+				withProgress(0, IncrementalCount, func(_ int64, partial promql.Vector) {
+					progress = partial[0].V
+				}))
+			for exact.Next() {
+				require.True(t, bucketed.Next())
+				_, expected := exact.At(countOverTime)
+				_, actual := bucketed.At(countOverTime)
+				require.InDelta(t, expected[0].V, actual[0].V, tc.delta)
+				// counts, sums and rates agree.
+				_, sums := bucketed.At(sumOverTime)
+				require.Equal(t, actual[0].V, sums[0].V)
+				_, rates := bucketed.At(rateLogs(5 * time.Second))
+				require.Equal(t, actual[0].V/5, rates[0].V)
+				require.LessOrEqual(t, len(bucketed.window[`{app="foo"}`].Points), 6)
+				// every reader sees the bucket counts.
+				require.Equal(t, actual[0].V, bucketed.Snapshot().Aggregate(countOverTime)[0].V)
+				require.Equal(t, actual[0].V, progress)
+				_, partitions := bucketed.AtPartitioned(func(v float64) bool { return v == 1 }, countOverTime, "one", "other")
+				for _, s := range partitions {
+					if s.Metric.Get(partitionLabel) == "one" {
+						require.Equal(t, actual[0].V, s.V)
+					}
+				}
+				_, bounds := bucketed.AtConfidenceInterval(0.95)
+				for _, s := range bounds {
+					require.Equal(t, 1., s.V)
+				}
+			}
+			require.False(t, bucketed.Next())
+		})
+	}
+}
+
+func Test_RangeVectorIteratorValid(t *testing.T) {
+	it := newRangeVectorIterator(newfakeSeriesIterator(),
+		(30 * time.Second).Nanoseconds(), (30 * time.Second).Nanoseconds(),
+		time.Unix(100, 0).UnixNano(), time.Unix(10, 0).UnixNano())
+	require.False(t, it.Valid())
+	require.Equal(t, "the start of the query range is after its end", it.Reason())
+	require.False(t, it.Next())
+
+	it = newRangeVectorIterator(newfakeSeriesIterator(),
+		(30 * time.Second).Nanoseconds(), (30 * time.Second).Nanoseconds(),
+		time.Unix(10, 0).UnixNano(), time.Unix(100, 0).UnixNano())
+	require.True(t, it.Valid())
+	require.Empty(t, it.Reason())
+
+	it = newRangeVectorIterator(newfakeSeriesIterator(),
+		(30 * time.Second).Nanoseconds(), -(30 * time.Second).Nanoseconds(),
+		time.Unix(10, 0).UnixNano(), time.Unix(100, 0).UnixNano())
+	require.False(t, it.Valid())
+	require.Equal(t, "the query step is negative", it.Reason())
+	require.False(t, it.Next())
+
+	// a negative step is not coarsened to the minimum step.
+	it = newRangeVectorIterator(newfakeSeriesIterator(),
+		(30 * time.Second).Nanoseconds(), -(30 * time.Second).Nanoseconds(),
+		time.Unix(10, 0).UnixNano(), time.Unix(100, 0).UnixNano(), withMinStep(time.Second.Nanoseconds()))
+	adjusted, _, _ := it.StepAdjusted()
+	require.False(t, adjusted)
+	require.False(t, it.Valid())
+	require.False(t, it.Next())
+
+	it = newRangeVectorIterator(newfakeSeriesIterator(),
+		-(30 * time.Second).Nanoseconds(), (30 * time.Second).Nanoseconds(),
+		time.Unix(10, 0).UnixNano(), time.Unix(100, 0).UnixNano())
+	require.False(t, it.Valid())
+	require.Equal(t, "the range of the query is negative", it.Reason())
+	require.False(t, it.Next())
+}
+
+func Test_RangeVectorIteratorAtDistinctRate(t *testing.T) {
+	it := newRangeVectorIterator(newSliceSeriesIterator(
+		Sample{Labels: `{app="foo", user="a"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 1},
+		Sample{Labels: `{app="foo", user="b"}`, TimestampNano: time.Unix(2, 0).UnixNano(), Value: 1},
+		Sample{Labels: `{app="foo", user="a"}`, TimestampNano: time.Unix(3, 0).UnixNano(), Value: 1},
+		Sample{Labels: `{app="foo", user="c", version="2"}`, TimestampNano: time.Unix(4, 0).UnixNano(), Value: 1},
+		Sample{Labels: `{app="bar", user="a"}`, TimestampNano: time.Unix(5, 0).UnixNano(), Value: 1},
+		Sample{Labels: `{app="bar"}`, TimestampNano: time.Unix(6, 0).UnixNano(), Value: 1},
+	), (10 * time.Second).Nanoseconds(), (10 * time.Second).Nanoseconds(),
+		time.Unix(10, 0).UnixNano(), time.Unix(10, 0).UnixNano())
+
+	require.True(t, it.Next())
+	_, v := it.AtDistinctRate("user", []string{"app"})
+	require.ElementsMatch(t, promql.Vector{
+		{Point: newPoint(time.Unix(10, 0), 0.3), Metric: labelFoo},
+		{Point: newPoint(time.Unix(10, 0), 0.1), Metric: labelBar},
+	}, v)
+
+	it = newRangeVectorIterator(newSliceSeriesIterator(
+		Sample{Labels: `{app="foo", region="eu", user="a"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 1},
+		Sample{Labels: `{app="foo", region="eu", user="b"}`, TimestampNano: time.Unix(2, 0).UnixNano(), Value: 1},
+		Sample{Labels: `{app="bar", region="eu", user="c"}`, TimestampNano: time.Unix(3, 0).UnixNano(), Value: 1},
+	), (10 * time.Second).Nanoseconds(), (10 * time.Second).Nanoseconds(),
+		time.Unix(10, 0).UnixNano(), time.Unix(10, 0).UnixNano())
+
+	require.True(t, it.Next())
+	by := []string{"region", "app"}
+	_, v = it.AtDistinctRate("user", by)
+	require.ElementsMatch(t, promql.Vector{
+		{Point: newPoint(time.Unix(10, 0), 0.2), Metric: labels.Labels{{Name: "app", Value: "foo"}, {Name: "region", Value: "eu"}}},
+		{Point: newPoint(time.Unix(10, 0), 0.1), Metric: labels.Labels{{Name: "app", Value: "bar"}, {Name: "region", Value: "eu"}}},
+	}, v)
+	require.Equal(t, []string{"region", "app"}, by)
+
+	// groups go through the coverage, rounding and time of day bucket of At.
+	it = newRangeVectorIterator(newSliceSeriesIterator(
+		Sample{Labels: `{app="foo", user="a"}`, TimestampNano: time.Unix(4, 0).UnixNano(), Value: 1},
+		Sample{Labels: `{app="foo", user="b"}`, TimestampNano: time.Unix(5, 0).UnixNano(), Value: 1},
+		Sample{Labels: `{app="foo", user="c"}`, TimestampNano: time.Unix(5, 0).UnixNano(), Value: 1},
+		Sample{Labels: `{app="foo", user="a"}`, TimestampNano: time.Unix(6, 0).UnixNano(), Value: 1},
+		Sample{Labels: `{app="foo", user="b"}`, TimestampNano: time.Unix(7, 0).UnixNano(), Value: 1},
+		Sample{Labels: `{app="foo", user="c"}`, TimestampNano: time.Unix(8, 0).UnixNano(), Value: 1},
+		Sample{Labels: `{app="foo", user="d"}`, TimestampNano: time.Unix(8, 0).UnixNano(), Value: 1},
+	), (7 * time.Second).Nanoseconds(), (10 * time.Second).Nanoseconds(),
+		time.Unix(10, 0).UnixNano(), time.Unix(10, 0).UnixNano(),
+		withMinCoverage(0.2), withRounding(2), withTimeOfDayBucket(func(int64) string { return "night" }))
+
+	require.True(t, it.Next())
+	_, v = it.AtDistinctRate("user", []string{"app"})
+	require.Equal(t, map[string]float64{`{__tod_bucket__="night", app="foo"}`: 0.43}, vectorValues(v))
+}
+
+func Test_RangeVectorIteratorMaxLabelNames(t *testing.T) {
+	const excessive = `{a="1", b="2", c="3", d="4"}`
+	it := newRangeVectorIterator(newSliceSeriesIterator(
+		Sample{Labels: excessive, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 1},
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(2, 0).UnixNano(), Value: 1},
+		Sample{Labels: excessive, TimestampNano: time.Unix(3, 0).UnixNano(), Value: 1},
+		Sample{Labels: `{app="foo", env="prod", region="eu"}`, TimestampNano: time.Unix(4, 0).UnixNano(), Value: 1},
+	), (10 * time.Second).Nanoseconds(), (10 * time.Second).Nanoseconds(),
+		time.Unix(10, 0).UnixNano(), time.Unix(10, 0).UnixNano(), withMaxLabelNames(3))
+
+	require.True(t, it.Next())
+	_, v := it.At(countOverTime)
+	require.ElementsMatch(t, promql.Vector{
+		{Point: newPoint(time.Unix(10, 0), 1), Metric: labelFoo},
+		{Point: newPoint(time.Unix(10, 0), 1), Metric: labels.Labels{{Name: "app", Value: "foo"}, {Name: "env", Value: "prod"}, {Name: "region", Value: "eu"}}},
+	}, v)
+	require.Equal(t, 1, it.RejectedSeries())
+}
+
+func Test_RangeVectorIteratorAtConfidenceInterval(t *testing.T) {
+	it := newRangeVectorIterator(newSliceSeriesIterator(
+		Sample{Labels: `{app="bar"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 7},
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 2},
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(2, 0).UnixNano(), Value: 4},
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(3, 0).UnixNano(), Value: 4},
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(4, 0).UnixNano(), Value: 6},
+	), (10 * time.Second).Nanoseconds(), (10 * time.Second).Nanoseconds(),
+		time.Unix(10, 0).UnixNano(), time.Unix(10, 0).UnixNano())
+
+	require.True(t, it.Next())
+	_, v := it.AtConfidenceInterval(0.95)
+	bounds := map[string]float64{}
+	for _, s := range v {
+		bounds[s.Metric.Get("app")+"/"+s.Metric.Get(boundLabel)] = s.V
+	}
+	require.Len(t, bounds, 4)
+	// bar has a single sample.
+	require.Equal(t, 7., bounds["bar/mean"])
+	// the sample stddev of foo is sqrt(8/3).
+	margin := 1.959964 * math.Sqrt(8./3) / 2
+	require.Equal(t, 4., bounds["foo/mean"])
+	require.InDelta(t, 4-margin, bounds["foo/lower"], 1e-6)
+	require.InDelta(t, 4+margin, bounds["foo/upper"], 1e-6)
+
+	// bounds go through the coverage, rounding and time of day bucket of At, a bound label of the
+	// source is kept.
+	it = newRangeVectorIterator(newSliceSeriesIterator(
+		Sample{Labels: `{app="bar"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 7},
+		Sample{Labels: `{app="foo", bound="a"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 2},
+		Sample{Labels: `{app="foo", bound="a"}`, TimestampNano: time.Unix(2, 0).UnixNano(), Value: 4},
+		Sample{Labels: `{app="foo", bound="a"}`, TimestampNano: time.Unix(3, 0).UnixNano(), Value: 4},
+		Sample{Labels: `{app="foo", bound="a"}`, TimestampNano: time.Unix(4, 0).UnixNano(), Value: 6},
+	), (10 * time.Second).Nanoseconds(), (10 * time.Second).Nanoseconds(),
+		time.Unix(10, 0).UnixNano(), time.Unix(10, 0).UnixNano(),
+		withMinCoverage(0.2), withRounding(2), withTimeOfDayBucket(func(int64) string { return "night" }))
+
+	require.True(t, it.Next())
+	_, v = it.AtConfidenceInterval(0.95)
+	require.Equal(t, map[string]float64{
+		`{__bound__="lower", __tod_bucket__="night", app="foo", bound="a"}`: 2.4,
+		`{__bound__="mean", __tod_bucket__="night", app="foo", bound="a"}`:  4,
+		`{__bound__="upper", __tod_bucket__="night", app="foo", bound="a"}`: 5.6,
+	}, vectorValues(v))
+}
+
+func Test_RangeVectorIteratorMinStep(t *testing.T) {
+	it := newRangeVectorIterator(newfakeSeriesIterator(),
+		(30 * time.Second).Nanoseconds(), time.Millisecond.Nanoseconds(),
+		time.Unix(10, 0).UnixNano(), time.Unix(12, 0).UnixNano(), withMinStep(time.Second.Nanoseconds()))
+	adjusted, requested, effective := it.StepAdjusted()
+	require.True(t, adjusted)
+	require.Equal(t, time.Millisecond.Nanoseconds(), requested)
+	require.Equal(t, time.Second.Nanoseconds(), effective)
+
+	var steps []int64
+	for it.Next() {
+		ts, _ := it.At(countOverTime)
+		steps = append(steps, ts)
+	}
+	require.Equal(t, []int64{10000, 11000, 12000}, steps)
+
+	it = newRangeVectorIterator(newfakeSeriesIterator(),
+		(30 * time.Second).Nanoseconds(), (2 * time.Second).Nanoseconds(),
+		time.Unix(10, 0).UnixNano(), time.Unix(12, 0).UnixNano(), withMinStep(time.Second.Nanoseconds()))
+	adjusted, _, effective = it.StepAdjusted()
+	require.False(t, adjusted)
+	require.Equal(t, (2 * time.Second).Nanoseconds(), effective)
+}
+
+func Test_RangeVectorIteratorOutputTsOffset(t *testing.T) {
+	offset := (2 * time.Hour).Nanoseconds()
+	newIt := func(opts ...rangeVectorIteratorOption) *rangeVectorIterator {
+		return newRangeVectorIterator(newfakeSeriesIterator(),
+			(5 * time.Second).Nanoseconds(), (30 * time.Second).Nanoseconds(),
+			time.Unix(10, 0).UnixNano(), time.Unix(100, 0).UnixNano(), opts...)
+	}
+	var progress, consumed []int64
+	plain := newIt()
+	shifted := newIt(withOutputTsOffset(offset), withProgress(0, IncrementalCount, func(ts int64, _ promql.Vector) {
+		progress = append(progress, ts)
+	}))
+	shifted.Register(func(s WindowSnapshot) {
+		consumed = append(consumed, s.Timestamp())
+		for _, sample := range s.Aggregate(countOverTime) {
+			require.Equal(t, s.Timestamp(), sample.T)
+		}
+	})
+	for plain.Next() {
+		progress, consumed = progress[:0], consumed[:0]
+		require.True(t, shifted.Next())
+		ts, vec := plain.At(countOverTime)
+		shiftedTs, shiftedVec := shifted.At(countOverTime)
+		require.Equal(t, ts+offset/1e+6, shiftedTs)
+		require.Equal(t, len(vec), len(shiftedVec))
+		for _, s := range shiftedVec {
+			require.Equal(t, shiftedTs, s.T)
+		}
+		require.Equal(t, vectorValues(vec), vectorValues(shiftedVec))
+		require.Equal(t, []int64{shiftedTs}, consumed)
+		for _, ts := range progress {
+			require.Equal(t, shiftedTs, ts)
+		}
+
+		// the variants of At are shifted alike.
+		for _, variant := range []func() (int64, promql.Vector){
+			func() (int64, promql.Vector) { return shifted.AtDistinctRate("app", nil) },
+			func() (int64, promql.Vector) { return shifted.AtConfidenceInterval(0.95) },
+			func() (int64, promql.Vector) {
+				return shifted.AtPartitioned(func(float64) bool { return true }, countOverTime, "all", "none")
+			},
+		} {
+			variantTs, variantVec := variant()
+			require.Equal(t, shiftedTs, variantTs)
+			for _, s := range variantVec {
+				require.Equal(t, shiftedTs, s.T)
+			}
+		}
+	}
+	require.False(t, shifted.Next())
+}
+
+func vectorValues(vec promql.Vector) map[string]float64 {
+	values := make(map[string]float64, len(vec))
+	for _, s := range vec {
+		values[s.Metric.String()] = s.V
+	}
+	return values
+}
+
+func Test_ActivationCountIterator(t *testing.T) {
+	var (
+		a = labels.Labels{{Name: "app", Value: "a"}}
+		b = labels.Labels{{Name: "app", Value: "b"}}
+		c = labels.Labels{{Name: "app", Value: "c"}}
+	)
+	it := NewActivationCountIterator(&vectorsIterator{
+		ts: []int64{1000, 2000, 3000, 4000, 5000},
+		vectors: []promql.Vector{
+			// a activates, b is inactive.
+			{{Metric: a, Point: promql.Point{V: 1}}, {Metric: b, Point: promql.Point{V: 0}}},
+			// b activates, a stays active.
+			{{Metric: a, Point: promql.Point{V: 2}}, {Metric: b, Point: promql.Point{V: 3}}},
+			// c appears, b goes back to zero and a is absent.
+			{{Metric: b, Point: promql.Point{V: 0}}, {Metric: c, Point: promql.Point{V: 4}}},
+			// a and b activate again.
+			{{Metric: a, Point: promql.Point{V: 1}}, {Metric: b, Point: promql.Point{V: 1}}, {Metric: c, Point: promql.Point{V: 1}}},
+			{},
+		},
+	}, sumOverTime)
+
+	var counts []float64
+	for {
+		next, ts, vec := it.Next()
+		if !next {
+			break
+		}
+		require.Len(t, vec, 1)
+		require.Equal(t, ts, vec[0].T)
+		counts = append(counts, vec[0].V)
+	}
+	require.Equal(t, []float64{1, 1, 1, 2, 0}, counts)
+	require.NoError(t, it.Error())
+	require.NoError(t, it.Close())
+}
+
+func Test_BaselineRelativeIterator(t *testing.T) {
+	var (
+		a = labels.Labels{{Name: "app", Value: "a"}}
+		b = labels.Labels{{Name: "app", Value: "b"}}
+		c = labels.Labels{{Name: "app", Value: "c"}}
+	)
+	newIt := func() RangeVectorIterator {
+		return &vectorsIterator{
+			ts: []int64{1000, 2000, 3000},
+			vectors: []promql.Vector{
+				{{Metric: a, Point: promql.Point{V: 10}}, {Metric: c, Point: promql.Point{V: 0}}},
+				// b appears with its baseline.
+				{{Metric: a, Point: promql.Point{V: 20}}, {Metric: b, Point: promql.Point{V: 4}}, {Metric: c, Point: promql.Point{V: 1}}},
+				{{Metric: a, Point: promql.Point{V: 5}}, {Metric: b, Point: promql.Point{V: 2}}},
+			},
+		}
+	}
+	eval := func(mode BaselineMode) []map[string]float64 {
+		it := NewBaselineRelativeIterator(newIt(), sumOverTime, mode)
+		var steps []map[string]float64
+		for {
+			next, _, vec := it.Next()
+			if !next {
+				break
+			}
+			steps = append(steps, vectorValues(vec))
+		}
+		require.NoError(t, it.Error())
+		return steps
+	}
+
+	ratios := eval(BaselineRatio)
+	require.Len(t, ratios, 3)
+	require.Equal(t, 1., ratios[0][`{app="a"}`])
+	require.Equal(t, 2., ratios[1][`{app="a"}`])
+	require.Equal(t, 1., ratios[1][`{app="b"}`])
+	require.Equal(t, 0.5, ratios[2][`{app="a"}`])
+	require.Equal(t, 0.5, ratios[2][`{app="b"}`])
+	// a zero baseline cannot be divided by.
+	require.True(t, math.IsNaN(ratios[0][`{app="c"}`]))
+	require.True(t, math.IsNaN(ratios[1][`{app="c"}`]))
+
+	require.Equal(t, []map[string]float64{
+		{`{app="a"}`: 0, `{app="c"}`: 0},
+		{`{app="a"}`: 10, `{app="b"}`: 0, `{app="c"}`: 1},
+		{`{app="a"}`: -5, `{app="b"}`: -2},
+	}, eval(BaselineDifference))
+}
+
+func Test_RangeVectorIteratorAtPartitioned(t *testing.T) {
+	it := newRangeVectorIterator(newSliceSeriesIterator(
+		Sample{Labels: `{app="bar"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 7},
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 2},
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(2, 0).UnixNano(), Value: -4},
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(3, 0).UnixNano(), Value: 3},
+		Sample{Labels: `{app="foo"}`, TimestampNano: time.Unix(4, 0).UnixNano(), Value: -1},
+	), (10 * time.Second).Nanoseconds(), (10 * time.Second).Nanoseconds(),
+		time.Unix(10, 0).UnixNano(), time.Unix(10, 0).UnixNano())
+
+	require.True(t, it.Next())
+	ts, v := it.AtPartitioned(func(v float64) bool { return v > 0 }, sumOverTime, "positive", "negative")
+	require.Equal(t, int64(10000), ts)
+	require.Equal(t, map[string]float64{
+		`{__partition__="positive", app="bar"}`: 7,
+		`{__partition__="negative", app="bar"}`: 0,
+		`{__partition__="positive", app="foo"}`: 5,
+		`{__partition__="negative", app="foo"}`: -5,
+	}, vectorValues(v))
+
+	// the window is left untouched.
+	_, v = it.At(sumOverTime)
+	require.Equal(t, map[string]float64{`{app="bar"}`: 7, `{app="foo"}`: 0}, vectorValues(v))
+
+	// partitions go through the coverage, rounding and time of day bucket of At, a partition label
+	// of the source is kept.
+	it = newRangeVectorIterator(newSliceSeriesIterator(
+		Sample{Labels: `{app="bar"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 7},
+		Sample{Labels: `{app="foo", partition="a"}`, TimestampNano: time.Unix(1, 0).UnixNano(), Value: 2},
+		Sample{Labels: `{app="foo", partition="a"}`, TimestampNano: time.Unix(2, 0).UnixNano(), Value: -4},
+		Sample{Labels: `{app="foo", partition="a"}`, TimestampNano: time.Unix(3, 0).UnixNano(), Value: 3},
+		Sample{Labels: `{app="foo", partition="a"}`, TimestampNano: time.Unix(4, 0).UnixNano(), Value: -1},
+	), (10 * time.Second).Nanoseconds(), (10 * time.Second).Nanoseconds(),
+		time.Unix(10, 0).UnixNano(), time.Unix(10, 0).UnixNano(),
+		withMinCoverage(0.2), withRounding(0), withTimeOfDayBucket(func(int64) string { return "night" }))
+
+	require.True(t, it.Next())
+	avg := func(points []promql.Point) float64 { return sumOverTime(points) / countOverTime(points) }
+	_, v = it.AtPartitioned(func(v float64) bool { return v > 0 }, avg, "positive", "negative")
+	require.Equal(t, map[string]float64{
+		`{__partition__="positive", __tod_bucket__="night", app="foo", partition="a"}`: 3,
+		`{__partition__="negative", __tod_bucket__="night", app="foo", partition="a"}`: -3,
+	}, vectorValues(v))
+}
+
+func Test_RangeVectorIteratorWithSeed(t *testing.T) {
+	var (
+		samples []Sample
+		seed    = map[string]*promql.Series{}
+	)
+	for i := int64(1); i <= 20; i++ {
+		for _, lbs := range []string{`{app="bar"}`, `{app="foo"}`} {
+			samples = append(samples, Sample{Labels: lbs, TimestampNano: time.Unix(i, 0).UnixNano(), Value: float64(i)})
+		}
+	}
+	// the previous evaluation ended at 10s, leaving the tail of its window.
+	var fresh []Sample
+	for _, s := range samples {
+		if s.TimestampNano > time.Unix(10, 0).UnixNano() {
+			fresh = append(fresh, s)
+			continue
+		}
+		if s.TimestampNano <= time.Unix(5, 0).UnixNano() {
+			continue
+		}
+		series, ok := seed[s.Labels]
+		if !ok {
+			metric, err := parser.ParseMetric(s.Labels)
+			require.NoError(t, err)
+			series = &promql.Series{Metric: metric}
+			seed[s.Labels] = series
+		}
+		series.Points = append(series.Points, promql.Point{T: s.TimestampNano, V: s.Value})
+	}
+
+	var (
+		selRange   = (10 * time.Second).Nanoseconds()
+		step       = (5 * time.Second).Nanoseconds()
+		start, end = time.Unix(15, 0).UnixNano(), time.Unix(20, 0).UnixNano()
+		cold       = newRangeVectorIterator(newSliceSeriesIterator(samples...), selRange, step, start, end)
+		seeded     = newRangeVectorIteratorWithSeed(newSliceSeriesIterator(fresh...), seed, selRange, step, start, end)
+	)
+	var steps int
+	for cold.Next() {
+		require.True(t, seeded.Next())
+		ts, vec := cold.At(sumOverTime)
+		seededTs, seededVec := seeded.At(sumOverTime)
+		require.Equal(t, ts, seededTs)
+		require.Equal(t, vectorValues(vec), vectorValues(seededVec))
+		steps++
+	}
+	require.False(t, seeded.Next())
+	require.Equal(t, 2, steps)
+	// the seed window is left untouched.
+	require.Len(t, seed[`{app="foo"}`].Points, 5)
+}
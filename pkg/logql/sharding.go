@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
 	"time"
 
 	"github.com/cortexproject/cortex/pkg/querier/astmapper"
@@ -369,6 +370,98 @@ func ConcatEvaluator(evaluators []StepEvaluator) (StepEvaluator, error) {
 	)
 }
 
+// DedupeMergeEvaluator merges the steps of shard iterators, whose time ranges may overlap e.g when
+// shards over-read. Steps are emitted in order and a series emitted at the same step by several
+// shards is only kept once, as long as all of them agree on its value: an error is reported
+// otherwise instead of double counting it.
+func DedupeMergeEvaluator(agg RangeVectorAggregator, its []RangeVectorIterator) (StepEvaluator, error) {
+	type head struct {
+		ok  bool
+		ts  int64
+		vec promql.Vector
+	}
+	var (
+		heads   = make([]head, len(its))
+		started bool
+		err     error
+	)
+	advance := func(i int) {
+		heads[i] = head{}
+		if nextLoaded(its[i]) {
+			ts, vec := its[i].At(agg)
+			heads[i] = head{ok: true, ts: ts, vec: vec}
+		}
+	}
+	return newStepEvaluator(
+		func() (bool, int64, promql.Vector) {
+			if !started {
+				for i := range its {
+					advance(i)
+				}
+				started = true
+			}
+			if err != nil {
+				return false, 0, nil
+			}
+			var (
+				ts    int64
+				found bool
+			)
+			for _, h := range heads {
+				if h.ok && (!found || h.ts < ts) {
+					ts, found = h.ts, true
+				}
+			}
+			if !found {
+				return false, 0, nil
+			}
+			var (
+				vec  promql.Vector
+				seen = map[string]float64{}
+			)
+			for i, h := range heads {
+				if !h.ok || h.ts != ts {
+					continue
+				}
+				for _, s := range h.vec {
+					key := s.Metric.String()
+					v, ok := seen[key]
+					if !ok {
+						seen[key] = s.V
+						vec = append(vec, s)
+						continue
+					}
+					if v != s.V && !(math.IsNaN(v) && math.IsNaN(s.V)) {
+						err = fmt.Errorf("conflicting values for series %s at %d across shards: %v and %v", key, ts, v, s.V)
+						return false, 0, nil
+					}
+				}
+				advance(i)
+			}
+			return true, ts, vec
+		},
+		func() (lastErr error) {
+			for _, it := range its {
+				if err := it.Close(); err != nil {
+					lastErr = err
+				}
+			}
+			return lastErr
+		},
+		func() error {
+			if err != nil {
+				return err
+			}
+			for _, it := range its {
+				if err := it.Error(); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	)
+}
+
 // ResultStepEvaluator coerces a downstream vector or matrix into a StepEvaluator
 func ResultStepEvaluator(res Result, params Params) (StepEvaluator, error) {
 	var (
@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/stretchr/testify/require"
 
@@ -107,3 +108,60 @@ func approximatelyEquals(t *testing.T, as, bs promql.Matrix) {
 		require.Equal(t, a, b)
 	}
 }
+
+func TestDedupeMergeEvaluator(t *testing.T) {
+	var (
+		a = labels.Labels{{Name: "app", Value: "a"}}
+		b = labels.Labels{{Name: "app", Value: "b"}}
+	)
+	// both shards over-read the 2000 step.
+	shards := func(overlap float64) []RangeVectorIterator {
+		return []RangeVectorIterator{
+			&vectorsIterator{
+				ts: []int64{1000, 2000},
+				vectors: []promql.Vector{
+					{{Metric: a, Point: promql.Point{T: 1000, V: 1}}},
+					{{Metric: a, Point: promql.Point{T: 2000, V: 2}}, {Metric: b, Point: promql.Point{T: 2000, V: 3}}},
+				},
+			},
+			&vectorsIterator{
+				ts: []int64{2000, 3000},
+				vectors: []promql.Vector{
+					{{Metric: a, Point: promql.Point{T: 2000, V: overlap}}},
+					{{Metric: a, Point: promql.Point{T: 3000, V: 4}}},
+				},
+			},
+		}
+	}
+
+	eval, err := DedupeMergeEvaluator(sumOverTime, shards(2))
+	require.NoError(t, err)
+	var (
+		steps  []int64
+		result []promql.Vector
+	)
+	for {
+		next, ts, vec := eval.Next()
+		if !next {
+			break
+		}
+		steps = append(steps, ts)
+		result = append(result, vec)
+	}
+	require.NoError(t, eval.Error())
+	require.Equal(t, []int64{1000, 2000, 3000}, steps)
+	require.Equal(t, []promql.Vector{
+		{{Metric: a, Point: promql.Point{T: 1000, V: 1}}},
+		{{Metric: a, Point: promql.Point{T: 2000, V: 2}}, {Metric: b, Point: promql.Point{T: 2000, V: 3}}},
+		{{Metric: a, Point: promql.Point{T: 3000, V: 4}}},
+	}, result)
+
+	// shards disagreeing on the overlapping sample.
+	eval, err = DedupeMergeEvaluator(sumOverTime, shards(5))
+	require.NoError(t, err)
+	next, _, _ := eval.Next()
+	require.True(t, next)
+	next, _, _ = eval.Next()
+	require.False(t, next)
+	require.EqualError(t, eval.Error(), `conflicting values for series {app="a"} at 2000 across shards: 2 and 5`)
+}
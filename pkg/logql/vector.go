@@ -63,3 +63,33 @@ func (s *vectorByReverseValueHeap) Pop() interface{} {
 	*s = old[0 : n-1]
 	return el
 }
+
+// valueHeap is a min-heap of values.
+type valueHeap []float64
+
+func (s valueHeap) Len() int {
+	return len(s)
+}
+
+func (s valueHeap) Less(i, j int) bool {
+	if math.IsNaN(s[i]) {
+		return true
+	}
+	return s[i] < s[j]
+}
+
+func (s valueHeap) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s *valueHeap) Push(x interface{}) {
+	*s = append(*s, x.(float64))
+}
+
+func (s *valueHeap) Pop() interface{} {
+	old := *s
+	n := len(old)
+	el := old[n-1]
+	*s = old[0 : n-1]
+	return el
+}